@@ -0,0 +1,97 @@
+package tlspage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrCacheMiss is returned by a Cache when there is no data for the key.
+var ErrCacheMiss = errors.New("tlspage: cache miss")
+
+// Cache is used by Manager to store the private key and certificate chain.
+// Get must return ErrCacheMiss if there is no data for the key.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, data []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// DirCache is a Cache that stores each key as a file in a directory.
+// The directory is created with 0700 permissions if it does not exist.
+type DirCache string
+
+func (d DirCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), key))
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	return data, err
+}
+
+func (d DirCache) Put(ctx context.Context, key string, data []byte) error {
+	err := os.MkdirAll(string(d), 0700)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a partial file
+	tmp, err := os.CreateTemp(string(d), key+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(string(d), key))
+}
+
+func (d DirCache) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(string(d), key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MemCache is a Cache that keeps everything in memory. Use NewMemCache to create one.
+type MemCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+// NewMemCache returns an empty MemCache.
+func NewMemCache() *MemCache {
+	return &MemCache{data: make(map[string][]byte)}
+}
+
+func (c *MemCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (c *MemCache) Put(ctx context.Context, key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = append([]byte{}, data...)
+	return nil
+}
+
+func (c *MemCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+	return nil
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/9072997/tlspage"
 	"github.com/gregdel/pushover"
 )
 
@@ -60,14 +62,24 @@ func main() {
 		return
 	}
 
-	expected := fmt.Sprintf(
-		"*.%s.%s%s",
-		certData.PubkeySHA256[0:32],
-		certData.PubkeySHA256[32:64],
-		watchItem,
-	)
-	if subject != expected {
-		notify("Unexpected subject: %s, expected: %s", subject, expected)
+	if !strings.HasPrefix(subject, "*.") {
+		notify("Unexpected non-wildcard subject: %s", subject)
+	}
+	pinned, err := tlspage.ParseHostname(subject, root)
+	if err != nil {
+		notify("Unexpected subject: %s: %v", subject, err)
+	}
+	if pinned.IPLabel != "" {
+		notify("Unexpected IP label in subject: %s", subject)
+	}
+	if hex.EncodeToString(pinned.Fingerprint) != certData.PubkeySHA256 {
+		notify(
+			"Unexpected subject: %s, expected: *.%s.%s%s",
+			subject,
+			certData.PubkeySHA256[0:32],
+			certData.PubkeySHA256[32:64],
+			watchItem,
+		)
 	}
 
 	// TODO remove this once we are confident everything is working
@@ -0,0 +1,251 @@
+package tlspage
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a tls.page server. The zero value is not usable, use NewClient or set BaseURL.
+type Client struct {
+	// HTTPClient is used to make requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// BaseURL is the scheme, host and optional port of the server (ex: "https://tls.page").
+	BaseURL string
+
+	// Retries is the number of times a request is retried after a transient failure. A POST
+	// whose connection fails after it was sent is not retried, since the server may already be
+	// acting on it.
+	Retries int
+
+	// RetryDelay is the delay before the first retry. It doubles after each attempt.
+	// A Retry-After header from the server takes precedence.
+	RetryDelay time.Duration
+
+	// MaxRetryDelay caps the delay between retries, including one asked for with Retry-After.
+	MaxRetryDelay time.Duration
+}
+
+// ServerError is returned when the server responds with a non-200 status.
+type ServerError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server returned non-200 status: %s\n%s", e.Status, e.Body)
+}
+
+// NewClient returns a Client for the server at https://origin with default retry settings.
+func NewClient(origin string) *Client {
+	return &Client{
+		BaseURL:       "https://" + origin,
+		Retries:       3,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: time.Minute,
+	}
+}
+
+// CertFromCSR submits a PEM-encoded CSR to /cert-from-csr and returns a list of certificates.
+// The first certificate is the leaf certificate. The response is checked with VerifyCertificate.
+func (c *Client) CertFromCSR(ctx context.Context, csrPEM string) (certificatePEMs []string, err error) {
+	respBody, err := c.do(ctx, http.MethodPost, "/cert-from-csr", "application/pkcs10", []byte(csrPEM))
+	if err != nil {
+		return nil, err
+	}
+	certificatePEMs, err = splitPEMs(respBody)
+	if err != nil {
+		return nil, err
+	}
+	err = VerifyCertificate(csrPEM, certificatePEMs)
+	if err != nil {
+		return nil, fmt.Errorf("server returned an invalid certificate: %v", err)
+	}
+	return certificatePEMs, nil
+}
+
+// CertForHostname gets the certificate for a base name (ex: "xxx.xxx.tls.page") that the server
+// already has a CSR for. The first certificate is the leaf certificate. The response is checked
+// with VerifyCertificateForHostname.
+func (c *Client) CertForHostname(ctx context.Context, hostname string) (certificatePEMs []string, err error) {
+	respBody, err := c.do(ctx, http.MethodGet, "/cert/"+url.PathEscape(hostname), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	certificatePEMs, err = splitPEMs(respBody)
+	if err != nil {
+		return nil, err
+	}
+	err = VerifyCertificateForHostname(hostname, certificatePEMs)
+	if err != nil {
+		return nil, fmt.Errorf("server returned an invalid certificate: %v", err)
+	}
+	return certificatePEMs, nil
+}
+
+// HostnameFromCSR has the server validate a PEM-encoded CSR and returns the base name in it.
+func (c *Client) HostnameFromCSR(ctx context.Context, csrPEM string) (string, error) {
+	respBody, err := c.do(ctx, http.MethodPost, "/hostname-from-csr", "application/pkcs10", []byte(csrPEM))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(respBody)), nil
+}
+
+// HostnameFromCert asks the server for the base name of a PEM-encoded certificate.
+func (c *Client) HostnameFromCert(ctx context.Context, certPEM string) (string, error) {
+	respBody, err := c.do(ctx, http.MethodPost, "/hostname-from-cert", "application/x-pem-file", []byte(certPEM))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(respBody)), nil
+}
+
+// Status runs the server's health checks. It returns nil if the server is healthy.
+func (c *Client) Status(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodGet, "/status", "", nil)
+	return err
+}
+
+// do sends a request, retrying transient failures, and returns the body of a 200 response.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body []byte) ([]byte, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if _, err := url.Parse(u); err != nil {
+		return nil, fmt.Errorf("invalid server URL: %v", err)
+	}
+
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		respBody, retryAfter, err := c.doOnce(ctx, httpClient, method, u, contentType, body)
+		if err == nil {
+			return respBody, nil
+		}
+		if attempt >= c.Retries || !isTransient(ctx, method, err) {
+			return nil, err
+		}
+
+		wait := delay
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if c.MaxRetryDelay > 0 && wait > c.MaxRetryDelay {
+			wait = c.MaxRetryDelay
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, httpClient *http.Client, method, u, contentType string, body []byte) (respBody []byte, retryAfter time.Duration, err error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating request: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error sending request to server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = &ServerError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(respBody),
+		}
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), err
+	}
+	return respBody, 0, nil
+}
+
+// isTransient reports whether a failed request is worth retrying.
+func isTransient(ctx context.Context, method string, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		switch serverErr.StatusCode {
+		case http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	// anything else is a network error. Only requests that never reached the server are safe
+	// to send again if they aren't idempotent.
+	if method == http.MethodGet || method == http.MethodHead {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// parseRetryAfter parses a Retry-After header in either delay-seconds or HTTP-date form.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// splitPEMs splits a response body into individual PEM blocks.
+func splitPEMs(data []byte) ([]string, error) {
+	var pems []string
+	for {
+		block, remaining := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		pems = append(pems, string(pem.EncodeToMemory(block)))
+		data = remaining
+	}
+	if len(pems) == 0 {
+		return nil, fmt.Errorf("no PEM blocks found in response")
+	}
+	return pems, nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/9072997/tlspage"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// runInspect handles "inspect FILE...". It describes every private key, CSR and certificate in
+// the files, then checks that the certificates form a chain and that the leaf matches one of
+// the keys. It exits with status 1 if either check fails.
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	origin := fs.String("origin", "tls.page", "Domain the key-pinned hostnames are under")
+	var passphrase, p12Password []byte
+	secretFlag(fs, "key-passphrase-file", "File containing the passphrase for encrypted private keys", &passphrase)
+	secretFlag(fs, "p12-password-file", "File containing the password for PKCS#12 files", &p12Password)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s inspect [flags] FILE...\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Describes PEM, DER and PKCS#12 key, certificate, CSR and combined files. Give a key\n")
+		fmt.Fprintf(fs.Output(), "file and a chain file together to check that they match.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	var certs []*x509.Certificate
+	var keys []crypto.Signer
+	var keyFiles []string
+	for _, filename := range fs.Args() {
+		contents, err := readAnyFile(filename, passphrase, p12Password)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(tw, "%s:\n", filename)
+		for _, key := range contents.Keys {
+			describeKey(tw, key.Public(), *origin)
+			keys = append(keys, key)
+			keyFiles = append(keyFiles, filename)
+		}
+		for _, csr := range contents.CSRs {
+			describeCSR(tw, csr, *origin)
+		}
+		for _, cert := range contents.Certs {
+			describeCertificate(tw, cert, *origin)
+			certs = append(certs, cert)
+		}
+		for _, note := range contents.Notes {
+			fmt.Fprintf(tw, "  note\t%s\n", note)
+		}
+	}
+
+	ok := true
+	if len(certs) > 1 || (len(certs) > 0 && len(keys) > 0) {
+		fmt.Fprintf(tw, "checks:\n")
+	}
+	if len(certs) > 1 {
+		chainOK := true
+		for i := 0; i+1 < len(certs); i++ {
+			err := certs[i].CheckSignatureFrom(certs[i+1])
+			if err != nil {
+				fmt.Fprintf(tw, "  chain\tcertificate %d is not signed by certificate %d: %v\n", i+1, i+2, err)
+				chainOK = false
+				break
+			}
+		}
+		if chainOK {
+			fmt.Fprintf(tw, "  chain\tok (%d certificates, each signed by the next)\n", len(certs))
+		}
+		ok = ok && chainOK
+	}
+	if len(certs) > 0 && len(keys) > 0 {
+		match := ""
+		for i, key := range keys {
+			if publicKeysEqual(key.Public(), certs[0].PublicKey) {
+				match = keyFiles[i]
+				break
+			}
+		}
+		if match != "" {
+			fmt.Fprintf(tw, "  key match\tthe first certificate matches the private key in %s\n", match)
+		} else {
+			fmt.Fprintf(tw, "  key match\tNO, the first certificate is for a different key\n")
+			ok = false
+		}
+	}
+	tw.Flush()
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// fileContents is everything readAnyFile found in a file.
+type fileContents struct {
+	Keys  []crypto.Signer
+	CSRs  []*x509.CertificateRequest
+	Certs []*x509.Certificate
+	Notes []string // things that were skipped, such as encrypted keys without a passphrase
+}
+
+// readAnyFile reads a PEM file with any mix of keys, CSRs and certificates, a DER certificate,
+// key or CSR, or a PKCS#12 file.
+func readAnyFile(filename string, passphrase, p12Password []byte) (*fileContents, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	contents := &fileContents{}
+
+	block, rest := pem.Decode(data)
+	if block == nil {
+		err = contents.addDER(data, p12Password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		return contents, nil
+	}
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: failed to parse certificate: %v", filename, err)
+			}
+			contents.Certs = append(contents.Certs, cert)
+		case block.Type == "CERTIFICATE REQUEST" || block.Type == "NEW CERTIFICATE REQUEST":
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: failed to parse CSR: %v", filename, err)
+			}
+			contents.CSRs = append(contents.CSRs, csr)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keyPEM := string(pem.EncodeToMemory(block))
+			if tlspage.IsEncryptedPrivateKey(keyPEM) {
+				if passphrase == nil {
+					contents.Notes = append(contents.Notes, "encrypted private key skipped (use --key-passphrase-file)")
+					continue
+				}
+				keyPEM, err = tlspage.DecryptPrivateKey(keyPEM, passphrase)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", filename, err)
+				}
+			}
+			key, err := tlspage.ParsePrivateKey(keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", filename, err)
+			}
+			contents.Keys = append(contents.Keys, key)
+		default:
+			contents.Notes = append(contents.Notes, fmt.Sprintf("%s block skipped", block.Type))
+		}
+	}
+	return contents, nil
+}
+
+// addDER adds a DER certificate, private key or CSR, or the contents of a PKCS#12 file.
+func (contents *fileContents) addDER(data, p12Password []byte) error {
+	if cert, err := x509.ParseCertificate(data); err == nil {
+		contents.Certs = append(contents.Certs, cert)
+		return nil
+	}
+	if keyPEM, ok := pemFromDERPrivateKey(data); ok {
+		key, err := tlspage.ParsePrivateKey(keyPEM)
+		if err != nil {
+			return err
+		}
+		contents.Keys = append(contents.Keys, key)
+		return nil
+	}
+	if csr, err := x509.ParseCertificateRequest(data); err == nil {
+		contents.CSRs = append(contents.CSRs, csr)
+		return nil
+	}
+
+	privKey, cert, caCerts, err := pkcs12.DecodeChain(data, string(p12Password))
+	if err != nil {
+		return fmt.Errorf("not a PEM, DER or PKCS#12 file, or the PKCS#12 password is wrong (%v)", err)
+	}
+	key, ok := privKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key of type %T", privKey)
+	}
+	contents.Keys = append(contents.Keys, key)
+	contents.Certs = append(contents.Certs, cert)
+	contents.Certs = append(contents.Certs, caCerts...)
+	return nil
+}
+
+func describeKey(w io.Writer, pub crypto.PublicKey, origin string) {
+	keyType, err := tlspage.KeyTypeOf(pub)
+	if err != nil {
+		fmt.Fprintf(w, "  private key\t%v\n", err)
+		return
+	}
+	fingerprint, err := tlspage.SPKIFingerprint(pub)
+	if err != nil {
+		fmt.Fprintf(w, "  private key\t%v\n", err)
+		return
+	}
+	hostname, _ := tlspage.HostnameFromPublicKey(pub, origin)
+	fmt.Fprintf(w, "  private key\t%s\n", keyType)
+	fmt.Fprintf(w, "  fingerprint\t%x\n", fingerprint)
+	fmt.Fprintf(w, "  hostname\t%s\n", hostname)
+}
+
+func describeCSR(w io.Writer, csr *x509.CertificateRequest, origin string) {
+	fmt.Fprintf(w, "  CSR\t%s\n", strings.Join(csr.DNSNames, ", "))
+	hostname, err := tlspage.HostnameFromCSR(csr, origin)
+	if err != nil {
+		fmt.Fprintf(w, "  hostname\tnot key-pinned: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "  hostname\t%s\n", hostname)
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		fmt.Fprintf(w, "  signature\tinvalid: %v\n", err)
+	}
+}
+
+func describeCertificate(w io.Writer, cert *x509.Certificate, origin string) {
+	name := cert.Subject.String()
+	if len(cert.DNSNames) > 0 {
+		name = strings.Join(cert.DNSNames, ", ")
+	}
+	fmt.Fprintf(w, "  certificate\t%s\n", name)
+	fmt.Fprintf(w, "  issuer\t%s\n", cert.Issuer)
+	fmt.Fprintf(
+		w,
+		"  valid\t%s to %s (%s)\n",
+		cert.NotBefore.Format(time.RFC3339),
+		cert.NotAfter.Format(time.RFC3339),
+		describeExpiry(cert.NotAfter),
+	)
+	if !cert.IsCA {
+		hostname, err := tlspage.HostnameFromCertificate(cert, origin)
+		if err != nil {
+			fmt.Fprintf(w, "  hostname\tnot key-pinned: %v\n", err)
+		} else {
+			fmt.Fprintf(w, "  hostname\t%s\n", hostname)
+		}
+	}
+}
+
+func describeExpiry(notAfter time.Time) string {
+	days := int(time.Until(notAfter).Hours() / 24)
+	switch {
+	case time.Now().After(notAfter):
+		return fmt.Sprintf("expired %d days ago", -days)
+	case days == 1:
+		return "1 day left"
+	default:
+		return fmt.Sprintf("%d days left", days)
+	}
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	fa, err := tlspage.SPKIFingerprint(a)
+	if err != nil {
+		return false
+	}
+	fb, err := tlspage.SPKIFingerprint(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(fa, fb)
+}
+
+// runCSR handles "csr". It loads the private key, generating and saving one if there is none,
+// and writes a CSR for its key-pinned hostname. On an air-gapped machine the CSR can be carried
+// to one with network access and submitted to /cert-from-csr, and the chain brought back and
+// given to "install" with the same key flags.
+func runCSR(args []string) {
+	fs := flag.NewFlagSet("csr", flag.ExitOnError)
+	cfg := newCertConfig()
+	addKeyFlags(fs, cfg)
+	out := fs.String("out", "", "Write the CSR to this file instead of standard output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s csr [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Writes a CSR for the private key, generating the key if it doesn't exist.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := cfg.validateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PKCS11Module == "" && cfg.KeyFile == "" && cfg.DERKeyFile == "" {
+		log.Fatal("You must specify --key, --der-key or --pkcs11-module")
+	}
+
+	hostname, csrPEM, err := cfg.createCSR()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		fmt.Print(csrPEM)
+	} else {
+		err = cfg.writeFiles([]outputFile{{*out, "CSR file", []byte(csrPEM), cfg.CertMode}})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Created CSR for %s", hostname)
+}
+
+// createCSR returns a CSR for the private key, first saving the key if it is new.
+func (cfg *certConfig) createCSR() (hostname, csrPEM string, err error) {
+	unlock, err := cfg.lock()
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+
+	key, err := cfg.loadKey(true)
+	if err != nil {
+		return "", "", err
+	}
+	defer key.Close()
+
+	if key.Generated {
+		var files []outputFile
+		if cfg.KeyFile != "" {
+			files = append(files, outputFile{cfg.KeyFile, "private key file", []byte(key.StoredPEM), cfg.KeyMode})
+		}
+		if cfg.DERKeyFile != "" {
+			der, err := marshalDERPrivateKey(key.PEM)
+			if err != nil {
+				return "", "", fmt.Errorf("Error encoding DER private key: %v", err)
+			}
+			files = append(files, outputFile{cfg.DERKeyFile, "DER private key file", der, cfg.KeyMode})
+		}
+		err = cfg.writeFiles(files)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	hostname, err = tlspage.HostnameFromPublicKey(key.Signer.Public(), cfg.Origin)
+	if err != nil {
+		return "", "", fmt.Errorf("Error generating hostname: %v", err)
+	}
+	csrPEM, err = tlspage.GenerateCSRWithSigner(key.Signer, hostname)
+	if err != nil {
+		return "", "", fmt.Errorf("Error generating CSR: %v", err)
+	}
+	return hostname, csrPEM, nil
+}
+
+// runInstall handles "install FILE". FILE is a PEM certificate chain obtained elsewhere, for
+// example from /cert/{hostname}, or "-" for standard input. It is checked against the local
+// private key and written to the usual output files.
+func runInstall(args []string) {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	cfg := newCertConfig()
+	addKeyFlags(fs, cfg)
+	addOutputFlags(fs, cfg)
+	jsonOutput := outputFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s install [flags] FILE\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Checks a PEM certificate chain (\"-\" for standard input) against the private key\n")
+		fmt.Fprintf(fs.Output(), "and writes it to the output files. --days is ignored.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var chain []byte
+	if fs.Arg(0) == "-" {
+		chain, err = io.ReadAll(os.Stdin)
+	} else {
+		chain, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		log.Fatalf("Error reading certificate chain: %v", err)
+	}
+	var certPEMs []string
+	for block, rest := pem.Decode(chain); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certPEMs = append(certPEMs, string(pem.EncodeToMemory(block)))
+		}
+	}
+	if len(certPEMs) == 0 {
+		log.Fatalf("No PEM certificates found in %s", fs.Arg(0))
+	}
+
+	result, err := cfg.install(certPEMs)
+	if err == nil {
+		err = cfg.runDeployHook(result)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	r := cfg.newReport(result, err)
+	printReport(os.Stdout, r, *jsonOutput)
+	os.Exit(r.exitCode())
+}
+
+// install checks certPEMs against the existing private key and writes the output files. Unlike
+// run it never generates a key or contacts the server.
+func (cfg *certConfig) install(certPEMs []string) (*runResult, error) {
+	unlock, err := cfg.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	key, err := cfg.loadKey(false)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+
+	result, err := cfg.newResult(key)
+	if err != nil {
+		return nil, err
+	}
+	err = tlspage.VerifyCertificateForHostname(result.Hostname, certPEMs)
+	if err != nil {
+		return nil, fmt.Errorf("Certificate chain is not valid for this private key: %v", err)
+	}
+
+	result.FilesWritten, err = cfg.saveCertificates(certPEMs, key.PEM, key.StoredPEM)
+	if err != nil {
+		return nil, err
+	}
+	result.Renewed = true
+	result.NotBefore, result.NotAfter, err = leafValidity(certPEMs)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
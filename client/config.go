@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/9072997/tlspage"
+	"github.com/BurntSushi/toml"
+)
+
+// configFile is the format of the file given to --config. Top-level settings are defaults for
+// every [[certificate]].
+//
+//	origin = "tls.page"
+//	days = 30
+//
+//	[[certificate]]
+//	name = "web"
+//	chain = "/etc/nginx/tls/chain.pem"
+//	key = "/etc/nginx/tls/key.pem"
+//	deploy_hook = "systemctl reload nginx"
+type configFile struct {
+	Origin       string        `toml:"origin"`
+	Days         *int          `toml:"days"`
+	KeyType      string        `toml:"key_type"`
+	CertMode     string        `toml:"cert_mode"`
+	KeyMode      string        `toml:"key_mode"`
+	Owner        string        `toml:"owner"`
+	Group        string        `toml:"group"`
+	Backup       bool          `toml:"backup"`
+	Certificates []configEntry `toml:"certificate"`
+}
+
+type configEntry struct {
+	Name              string `toml:"name"`
+	Origin            string `toml:"origin"`
+	Cert              string `toml:"cert"`
+	Chain             string `toml:"chain"`
+	Key               string `toml:"key"`
+	Combined          string `toml:"combined"`
+	DERCert           string `toml:"der_cert"`
+	DERKey            string `toml:"der_key"`
+	P12               string `toml:"p12"`
+	P12PasswordFile   string `toml:"p12_password_file"`
+	P12Legacy         bool   `toml:"p12_legacy"`
+	Days              *int   `toml:"days"`
+	IP                string `toml:"ip"`
+	KeyType           string `toml:"key_type"`
+	CertMode          string `toml:"cert_mode"`
+	KeyMode           string `toml:"key_mode"`
+	Owner             string `toml:"owner"`
+	Group             string `toml:"group"`
+	Backup            *bool  `toml:"backup"`
+	DeployHook        string `toml:"deploy_hook"`
+	KeyPassphraseFile string `toml:"key_passphrase_file"`
+	EncryptKey        bool   `toml:"encrypt_key"`
+	PKCS11Module      string `toml:"pkcs11_module"`
+	PKCS11Token       string `toml:"pkcs11_token"`
+	PKCS11Key         string `toml:"pkcs11_key"`
+	PKCS11PINFile     string `toml:"pkcs11_pin_file"`
+}
+
+// loadConfig reads a config file and returns a validated certConfig for every entry.
+func loadConfig(path string) ([]*certConfig, error) {
+	var file configFile
+	md, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown setting %s", undecoded[0])
+	}
+	if len(file.Certificates) == 0 {
+		return nil, fmt.Errorf("no [[certificate]] entries")
+	}
+
+	var cfgs []*certConfig
+	names := make(map[string]bool)
+	// entries writing the same file would keep replacing each other's certificate
+	writers := make(map[string]string)
+	for i, entry := range file.Certificates {
+		if entry.Name == "" {
+			entry.Name = fmt.Sprintf("certificate %d", i+1)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("duplicate certificate name %q", entry.Name)
+		}
+		names[entry.Name] = true
+
+		cfg, err := entry.certConfig(&file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		for _, filename := range cfg.outputFilenames() {
+			abs, err := filepath.Abs(filename)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Name, err)
+			}
+			if other, ok := writers[abs]; ok {
+				return nil, fmt.Errorf("%s: %s is also written by %s", entry.Name, filename, other)
+			}
+			writers[abs] = entry.Name
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// outputFilenames returns the names of the files cfg writes.
+func (cfg *certConfig) outputFilenames() []string {
+	var filenames []string
+	for _, filename := range []string{
+		cfg.CertFile, cfg.ChainFile, cfg.KeyFile, cfg.CombinedFile,
+		cfg.DERCertFile, cfg.DERKeyFile, cfg.P12File,
+	} {
+		if filename != "" {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// certConfig fills in defaults from the top of the file and checks the entry.
+func (entry *configEntry) certConfig(file *configFile) (*certConfig, error) {
+	cfg := &certConfig{
+		Name:         entry.Name,
+		Origin:       firstNonEmpty(entry.Origin, file.Origin, "tls.page"),
+		CertFile:     entry.Cert,
+		ChainFile:    entry.Chain,
+		KeyFile:      entry.Key,
+		CombinedFile: entry.Combined,
+		DERCertFile:  entry.DERCert,
+		DERKeyFile:   entry.DERKey,
+		P12File:      entry.P12,
+		Days:         30,
+		IP:           entry.IP,
+		Owner:        firstNonEmpty(entry.Owner, file.Owner),
+		Group:        firstNonEmpty(entry.Group, file.Group),
+		Backup:       file.Backup,
+		DeployHook:   entry.DeployHook,
+		EncryptKey:   entry.EncryptKey,
+		PKCS11Module: entry.PKCS11Module,
+		PKCS11Token:  entry.PKCS11Token,
+		PKCS11Key:    entry.PKCS11Key,
+		P12Legacy:    entry.P12Legacy,
+	}
+	if entry.Backup != nil {
+		cfg.Backup = *entry.Backup
+	}
+	if entry.Days != nil {
+		cfg.Days = *entry.Days
+	} else if file.Days != nil {
+		cfg.Days = *file.Days
+	}
+
+	var err error
+	cfg.KeyType, err = tlspage.ParseKeyType(firstNonEmpty(entry.KeyType, file.KeyType, string(tlspage.KeyTypeECDSAP256)))
+	if err != nil {
+		return nil, err
+	}
+	cfg.CertMode, err = parseMode(firstNonEmpty(entry.CertMode, file.CertMode), defaultCertMode)
+	if err != nil {
+		return nil, fmt.Errorf("cert_mode: %v", err)
+	}
+	cfg.KeyMode, err = parseMode(firstNonEmpty(entry.KeyMode, file.KeyMode), defaultKeyMode)
+	if err != nil {
+		return nil, fmt.Errorf("key_mode: %v", err)
+	}
+
+	if entry.KeyPassphraseFile != "" {
+		cfg.Passphrase, err = readPassphrase(entry.KeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase: %v", err)
+		}
+	}
+	if entry.PKCS11PINFile != "" {
+		pin, err := readPassphrase(entry.PKCS11PINFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading PKCS#11 PIN: %v", err)
+		}
+		cfg.PKCS11PIN = string(pin)
+	}
+	if entry.P12PasswordFile != "" {
+		cfg.P12Password, err = readPassphrase(entry.P12PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading PKCS#12 password: %v", err)
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// runAll runs every certificate once and returns a report for each. Errors are logged as they
+// happen.
+func runAll(cfgs []*certConfig) []*report {
+	var reports []*report
+	for _, cfg := range cfgs {
+		result, err := cfg.run(time.Duration(cfg.Days) * 24 * time.Hour)
+		if err == nil && result.Renewed {
+			err = cfg.runDeployHook(result)
+		}
+		if err != nil {
+			cfg.logf("%v", err)
+		}
+		reports = append(reports, cfg.newReport(result, err))
+	}
+	return reports
+}
+
+// parseMode parses an octal file mode such as "0640", returning def for "".
+func parseMode(s string, def os.FileMode) (os.FileMode, error) {
+	if s == "" {
+		return def, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal file mode", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9072997/tlspage"
+)
+
+// writeConfig writes a config file to a temporary directory and returns its path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tlspage.toml")
+	err := os.WriteFile(path, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+origin = "example.com"
+days = 20
+key_mode = "0640"
+
+[[certificate]]
+name = "web"
+chain = "/etc/web/chain.pem"
+key = "/etc/web/key.pem"
+deploy_hook = "systemctl reload nginx"
+
+[[certificate]]
+combined = "/etc/mqtt/combined.pem"
+origin = "tls.page"
+days = 10
+key_type = "ed25519"
+cert_mode = "0600"
+`)
+	cfgs, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if len(cfgs) != 2 {
+		t.Fatalf("loadConfig() returned %d certificates, want 2", len(cfgs))
+	}
+
+	web := cfgs[0]
+	if web.Name != "web" || web.Origin != "example.com" || web.Days != 20 {
+		t.Errorf("web = %q, origin %q, days %d, want defaults from the top of the file", web.Name, web.Origin, web.Days)
+	}
+	if web.KeyType != tlspage.KeyTypeECDSAP256 || web.CertMode != defaultCertMode || web.KeyMode != 0640 {
+		t.Errorf("web key type %s, modes %v, %v, want %s, %v, 0640", web.KeyType, web.CertMode, web.KeyMode, tlspage.KeyTypeECDSAP256, defaultCertMode)
+	}
+	if web.DeployHook != "systemctl reload nginx" {
+		t.Errorf("web deploy hook = %q", web.DeployHook)
+	}
+
+	mqtt := cfgs[1]
+	if mqtt.Name != "certificate 2" || mqtt.Origin != "tls.page" || mqtt.Days != 10 {
+		t.Errorf("second entry = %q, origin %q, days %d, want its own settings", mqtt.Name, mqtt.Origin, mqtt.Days)
+	}
+	if mqtt.KeyType != tlspage.KeyTypeEd25519 || mqtt.CertMode != 0600 || mqtt.KeyMode != 0640 {
+		t.Errorf("second entry key type %s, modes %v, %v, want %s, 0600, 0640", mqtt.KeyType, mqtt.CertMode, mqtt.KeyMode, tlspage.KeyTypeEd25519)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "no entries",
+			config:  `origin = "tls.page"`,
+			wantErr: "no [[certificate]] entries",
+		},
+		{
+			name: "unknown setting",
+			config: `
+[[certificate]]
+combined = "/tmp/a.pem"
+cert_file = "/tmp/b.pem"
+`,
+			wantErr: "unknown setting",
+		},
+		{
+			name: "duplicate name",
+			config: `
+[[certificate]]
+name = "web"
+combined = "/tmp/a.pem"
+
+[[certificate]]
+name = "web"
+combined = "/tmp/b.pem"
+`,
+			wantErr: `duplicate certificate name "web"`,
+		},
+		{
+			name: "bad mode",
+			config: `
+[[certificate]]
+combined = "/tmp/a.pem"
+key_mode = "rw-------"
+`,
+			wantErr: "key_mode",
+		},
+		{
+			name: "missing key output",
+			config: `
+[[certificate]]
+cert = "/tmp/a.pem"
+`,
+			wantErr: "save the private key",
+		},
+		{
+			name: "same output path",
+			config: `
+[[certificate]]
+name = "web"
+cert = "/tmp/web/cert.pem"
+key = "/tmp/shared/key.pem"
+
+[[certificate]]
+name = "mqtt"
+combined = "/tmp/mqtt/../shared/key.pem"
+`,
+			wantErr: "mqtt: /tmp/mqtt/../shared/key.pem is also written by web",
+		},
+		{
+			name: "same output path in one entry",
+			config: `
+[[certificate]]
+name = "web"
+cert = "/tmp/web/cert.pem"
+chain = "/tmp/web/cert.pem"
+key = "/tmp/web/key.pem"
+`,
+			wantErr: "web: /tmp/web/cert.pem is also written by web",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/9072997/tlspage"
+)
+
+// newCertConfig returns a certConfig with the defaults used by the command line flags.
+func newCertConfig() *certConfig {
+	return &certConfig{
+		Origin:   "tls.page",
+		Days:     30,
+		KeyType:  tlspage.KeyTypeECDSAP256,
+		CertMode: defaultCertMode,
+		KeyMode:  defaultKeyMode,
+	}
+}
+
+// addKeyFlags registers the flags that say where the private key lives, how it is protected and
+// who owns the files it is written to.
+func addKeyFlags(fs *flag.FlagSet, cfg *certConfig) {
+	fs.StringVar(&cfg.Origin, "origin", cfg.Origin, "Server from which to get the certificate")
+	fs.StringVar(&cfg.KeyFile, "key", "", "Output private key file")
+	fs.StringVar(&cfg.DERKeyFile, "der-key", "", "Output DER-encoded PKCS#8 private key file (never encrypted)")
+	fs.Func("key-type", "Type of private key to generate if none exists (ecdsa-p256, ecdsa-p384, rsa-2048, rsa-3072, rsa-4096, ed25519; default ecdsa-p256)", func(s string) error {
+		keyType, err := tlspage.ParseKeyType(s)
+		cfg.KeyType = keyType
+		return err
+	})
+	secretFlag(fs, "key-passphrase-file", "File containing the passphrase for an encrypted private key", &cfg.Passphrase)
+	fs.BoolVar(&cfg.EncryptKey, "encrypt-key", false, "Write the private key encrypted with the passphrase from --key-passphrase-file")
+	fs.StringVar(&cfg.PKCS11Module, "pkcs11-module", "", "PKCS#11 module to load; the private key stays on the token and no key file is written")
+	fs.StringVar(&cfg.PKCS11Token, "pkcs11-token", "", "Label of the PKCS#11 token holding the private key")
+	fs.StringVar(&cfg.PKCS11Key, "pkcs11-key", "", "Label of the private key on the PKCS#11 token")
+	fs.Func("pkcs11-pin-file", "File containing the PKCS#11 user PIN", func(filename string) error {
+		pin, err := readPassphrase(filename)
+		cfg.PKCS11PIN = string(pin)
+		return err
+	})
+	fs.StringVar(&cfg.Owner, "owner", "", "User (name or ID) to own the output files")
+	fs.StringVar(&cfg.Group, "group", "", "Group (name or ID) to own the output files")
+	fs.Func("mode", "Permissions for files containing the private key, in octal (default 0600)", func(s string) error {
+		mode, err := parseMode(s, defaultKeyMode)
+		cfg.KeyMode = mode
+		return err
+	})
+	fs.Func("cert-mode", "Permissions for files without the private key, in octal (default 0644)", func(s string) error {
+		mode, err := parseMode(s, defaultCertMode)
+		cfg.CertMode = mode
+		return err
+	})
+}
+
+// addOutputFlags registers the flags for the certificate files and what happens when they are
+// renewed.
+func addOutputFlags(fs *flag.FlagSet, cfg *certConfig) {
+	fs.StringVar(&cfg.CertFile, "cert", "", "Output certificate file")
+	fs.StringVar(&cfg.ChainFile, "chain", "", "Output full-chain file (without private key)")
+	fs.StringVar(&cfg.CombinedFile, "combined", "", "Output combined file (with private key)")
+	fs.StringVar(&cfg.P12File, "p12", "", "Output password-protected PKCS#12 file (with private key and chain)")
+	secretFlag(fs, "p12-password-file", "File containing the password for --p12", &cfg.P12Password)
+	fs.BoolVar(&cfg.P12Legacy, "p12-legacy", false, "Encrypt --p12 with 3DES and SHA-1 for Windows before Server 2019 and Java before 8u301")
+	fs.StringVar(&cfg.DERCertFile, "der-cert", "", "Output DER-encoded certificate file (leaf only)")
+	fs.IntVar(&cfg.Days, "days", cfg.Days, "Minimum time remaining before certificate expiration in days")
+	fs.StringVar(&cfg.IP, "ip", "", "Print the hostname that resolves to this IP address instead of the base name")
+	fs.StringVar(&cfg.DeployHook, "deploy-hook", "", "Shell command to run after the certificate is renewed (see TLSPAGE_* environment variables)")
+	fs.BoolVar(&cfg.Backup, "backup", false, "Keep the previous output files as <name>.bak when renewing")
+}
+
+// outputFlag registers --output and returns whether JSON was selected.
+func outputFlag(fs *flag.FlagSet) *bool {
+	jsonOutput := new(bool)
+	fs.Func("output", "Output format: text (the hostname) or json (details of what happened)", func(s string) error {
+		switch s {
+		case "text":
+			*jsonOutput = false
+		case "json":
+			*jsonOutput = true
+		default:
+			return fmt.Errorf("must be text or json")
+		}
+		return nil
+	})
+	return jsonOutput
+}
+
+// secretFlag registers a flag naming a file whose contents (less a trailing newline) are stored
+// in dst.
+func secretFlag(fs *flag.FlagSet, name, usage string, dst *[]byte) {
+	fs.Func(name, usage, func(filename string) error {
+		secret, err := readPassphrase(filename)
+		*dst = secret
+		return err
+	})
+}
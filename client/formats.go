@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/9072997/tlspage"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// fileFormat is the encoding of a certificate output file.
+type fileFormat int
+
+const (
+	formatPEM fileFormat = iota
+	formatDER
+	formatPKCS12
+)
+
+// readLeafCertificate returns the leaf (first) certificate in filename, or nil if the file
+// doesn't exist. PKCS#12 files are opened with the --p12-password-file password.
+func (cfg *certConfig) readLeafCertificate(filename string, format fileFormat) (*x509.Certificate, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading certificate file: %v", err)
+	}
+
+	switch format {
+	case formatDER:
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing certificate in %s: %v", filename, err)
+		}
+		return cert, nil
+	case formatPKCS12:
+		_, cert, _, err := pkcs12.DecodeChain(data, string(cfg.P12Password))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading PKCS#12 file %s: %v", filename, err)
+		}
+		return cert, nil
+	}
+
+	remaining := data
+	for {
+		var block *pem.Block
+		block, remaining = pem.Decode(remaining)
+		if block == nil {
+			return nil, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing certificate: %v", err)
+		}
+		return cert, nil
+	}
+}
+
+// loadDERPrivateKey reads a DER-encoded PKCS#8, SEC1 or PKCS#1 private key and returns it as
+// PEM. It returns "" if the file doesn't exist.
+func loadDERPrivateKey(filename string) (string, error) {
+	der, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading private key file: %v", err)
+	}
+	privKeyPEM, ok := pemFromDERPrivateKey(der)
+	if !ok {
+		return "", fmt.Errorf("invalid private key format in file %s", filename)
+	}
+	return privKeyPEM, nil
+}
+
+// pemFromDERPrivateKey wraps a DER-encoded PKCS#8, SEC1 or PKCS#1 private key in the matching
+// PEM block. It returns false if der is none of those.
+func pemFromDERPrivateKey(der []byte) (string, bool) {
+	var blockType string
+	if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		blockType = "PRIVATE KEY"
+	} else if _, err := x509.ParseECPrivateKey(der); err == nil {
+		blockType = "EC PRIVATE KEY"
+	} else if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		blockType = "RSA PRIVATE KEY"
+	} else {
+		return "", false
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})), true
+}
+
+// loadPKCS12PrivateKey reads the private key from a PKCS#12 file and returns it as PEM. It
+// returns "" if the file doesn't exist.
+func loadPKCS12PrivateKey(filename string, password []byte) (string, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading PKCS#12 file: %v", err)
+	}
+	privKey, _, _, err := pkcs12.DecodeChain(data, string(password))
+	if err != nil {
+		return "", fmt.Errorf("error reading PKCS#12 file %s: %v", filename, err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return "", fmt.Errorf("unsupported private key in %s: %v", filename, err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})), nil
+}
+
+// marshalDERPrivateKey returns an unencrypted private key as DER-encoded PKCS#8.
+func marshalDERPrivateKey(privKeyPEM string) ([]byte, error) {
+	privKey, err := tlspage.ParsePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKCS8PrivateKey(privKey)
+}
+
+// marshalPKCS12 bundles the private key, leaf and chain into a password-protected PKCS#12
+// file. The default encryption (AES-256 with PBKDF2) is not supported by Windows before Server
+// 2019 or by Java before 8u301; legacy selects 3DES with a SHA-1 MAC for those.
+func marshalPKCS12(privKeyPEM string, certPEMs []string, password []byte, legacy bool) ([]byte, error) {
+	privKey, err := tlspage.ParsePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, certPEM := range certPEMs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode PEM certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	encoder := pkcs12.Modern2023
+	if legacy {
+		encoder = pkcs12.LegacyDES
+	}
+	return encoder.Encode(privKey, certs[0], certs[1:], string(password))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errLocked is returned by lockFile when wait is false and another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// lock takes an advisory lock on <first output file>.lock so that two runs for the same files
+// (say, overlapping cron jobs) don't both request a certificate and write over each other. It
+// waits for the other run to finish. The returned function releases the lock.
+func (cfg *certConfig) lock() (unlock func(), err error) {
+	path := firstNonEmpty(
+		cfg.KeyFile, cfg.CombinedFile, cfg.P12File, cfg.DERKeyFile,
+		cfg.CertFile, cfg.ChainFile, cfg.DERCertFile,
+	) + ".lock"
+
+	unlock, err = lockFile(path, false)
+	if err == errLocked {
+		cfg.logf("Waiting for another run to release %s", path)
+		unlock, err = lockFile(path, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error locking %s: %v", path, err)
+	}
+	return unlock, nil
+}
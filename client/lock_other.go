@@ -0,0 +1,38 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// a lock file older than this was left behind by a run that crashed
+const staleLockAge = time.Hour
+
+// lockFile creates path exclusively, for systems without flock(2). The file is removed when
+// the lock is released.
+func lockFile(path string, wait bool) (unlock func(), err error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+		if !wait {
+			return nil, errLocked
+		}
+		time.Sleep(time.Second)
+	}
+}
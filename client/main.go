@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -13,58 +16,396 @@ import (
 	"github.com/9072997/tlspage"
 )
 
+const (
+	defaultCertMode os.FileMode = 0644
+	defaultKeyMode  os.FileMode = 0600
+)
+
+// certConfig describes one certificate managed by the client and where its files go.
+type certConfig struct {
+	Name         string // only set in --config mode
+	Origin       string
+	CertFile     string
+	ChainFile    string
+	KeyFile      string
+	CombinedFile string
+	DERCertFile  string
+	DERKeyFile   string
+	P12File      string
+	Days         int
+	IP           string
+	KeyType      tlspage.KeyType
+	DeployHook   string
+
+	// permissions for the certificate, chain and DER certificate files, and for the files
+	// containing the private key
+	CertMode os.FileMode
+	KeyMode  os.FileMode
+
+	// user and group (names or IDs) to give the output files; "" leaves them alone
+	Owner string
+	Group string
+
+	// keep the previous files as <name>.bak when writing new ones
+	Backup bool
+
+	// passphrase for encrypted key files, and whether to encrypt plaintext ones
+	Passphrase []byte
+	EncryptKey bool
+
+	// password for the PKCS#12 file, and whether to use encryption old systems can read
+	P12Password []byte
+	P12Legacy   bool
+
+	// if PKCS11Module is set the key stays on a token and no key file is written
+	PKCS11Module string
+	PKCS11Token  string
+	PKCS11Key    string
+	PKCS11PIN    string
+
+	// client talks to the server. If nil, tlspage.NewClient(Origin) is used.
+	client *tlspage.Client
+
+	// capRenewal limits renewBefore to a third of the certificate's lifetime (see
+	// renewalThreshold). watch sets it so a --days longer than the certificate lasts doesn't
+	// renew it on every check.
+	capRenewal bool
+}
+
+// runResult describes the certificate after a run.
+type runResult struct {
+	Hostname    string // key-pinned base name
+	DisplayName string // Hostname, or the IP hostname if --ip was given
+	Renewed     bool
+	NotBefore   time.Time
+	NotAfter    time.Time
+
+	FilesWritten []string
+}
+
 func main() {
-	origin := flag.String("origin", "tls.page", "Server from which to get the certificate")
-	outCert := flag.String("cert", "", "Output certificate file")
-	outFullChain := flag.String("chain", "", "Output full-chain file (without private key)")
-	outKey := flag.String("key", "", "Output private key file")
-	outCombined := flag.String("combined", "", "Output combined file (with private key)")
-	requireDays := flag.Int("days", 30, "Minimum time remaining before certificate expiration in days")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "csr":
+			runCSR(os.Args[2:])
+			return
+		case "install":
+			runInstall(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "rotate":
+			runRotate(os.Args[2:])
+			return
+		}
+	}
+
+	cfg := newCertConfig()
+	addKeyFlags(flag.CommandLine, cfg)
+	addOutputFlags(flag.CommandLine, cfg)
+	watchMode := flag.Bool("watch", false, "Keep running and renew the certificate before it has fewer than --days left, or a third of its lifetime if that is shorter")
+	configPath := flag.String("config", "", "TOML file listing several certificates to manage; replaces the per-certificate flags")
+	jsonOutput := outputFlag(flag.CommandLine)
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage:\n")
+		fmt.Fprintf(out, "  %s [flags]                  get or renew a certificate\n", os.Args[0])
+		fmt.Fprintf(out, "  %s inspect [flags] FILE...  describe key and certificate files\n", os.Args[0])
+		fmt.Fprintf(out, "  %s csr [flags]              write a CSR for offline issuance\n", os.Args[0])
+		fmt.Fprintf(out, "  %s install [flags] FILE     install a certificate chain issued elsewhere\n", os.Args[0])
+		fmt.Fprintf(out, "  %s serve [flags]            serve a directory or proxy a local server over HTTPS\n", os.Args[0])
+		fmt.Fprintf(out, "  %s rotate [flags]           move to a new key and hostname\n", os.Args[0])
+		fmt.Fprintf(out, "\nExit status is %d if the certificate was unchanged, %d if it was renewed, %d on a\n", exitUnchanged, exitRenewed, exitLocalError)
+		fmt.Fprintf(out, "local error and %d if the server could not be reached or refused the request.\n", exitServerError)
+		fmt.Fprintf(out, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	validateOutputFiles(outKey, outCombined, outCert, outFullChain)
+	if *configPath != "" {
+		runConfig(*configPath, *watchMode, *jsonOutput)
+		return
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *watchMode {
+		if cfg.Days <= 0 {
+			log.Fatal("--watch requires --days to be greater than 0")
+		}
+		if *jsonOutput {
+			log.Fatal("--output json cannot be used with --watch")
+		}
+		watch(cfg)
+		return
+	}
 
-	privKeyPEM, err := loadOrGeneratePrivateKey(outKey, outCombined)
+	result, err := cfg.run(time.Duration(cfg.Days) * 24 * time.Hour)
+	if err == nil && result.Renewed {
+		err = cfg.runDeployHook(result)
+	}
 	if err != nil {
-		log.Fatalf("Error loading or generating private key: %v", err)
+		log.Print(err)
 	}
+	r := cfg.newReport(result, err)
+	printReport(os.Stdout, r, *jsonOutput)
+	os.Exit(r.exitCode())
+}
+
+// runConfig handles --config. Every certificate is processed once and a summary printed, or
+// with watch set each one is watched until the process is killed.
+func runConfig(path string, watchMode, jsonOutput bool) {
+	// per-certificate flags would be ambiguous with several certificates
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "watch" && f.Name != "output" {
+			log.Fatalf("--%s cannot be used with --config; set it in the config file instead", f.Name)
+		}
+	})
 
-	hostname, err := tlspage.Hostname(privKeyPEM, *origin)
+	cfgs, err := loadConfig(path)
 	if err != nil {
-		log.Fatalf("Error generating hostname: %v", err)
+		log.Fatalf("Error loading %s: %v", path, err)
 	}
 
-	if checkExistingCertificate(outCert, outFullChain, outCombined, requireDays) {
-		fmt.Println(hostname)
-		return
+	if watchMode {
+		if jsonOutput {
+			log.Fatal("--output json cannot be used with --watch")
+		}
+		for _, cfg := range cfgs {
+			if cfg.Days <= 0 {
+				log.Fatalf("%s: --watch requires days to be greater than 0", cfg.Name)
+			}
+		}
+		for _, cfg := range cfgs {
+			go watch(cfg)
+		}
+		select {}
+	}
+
+	reports := runAll(cfgs)
+	printReports(os.Stdout, reports, jsonOutput)
+	os.Exit(exitCode(reports))
+}
+
+// logf logs a message, prefixed with the certificate's name in --config mode.
+func (cfg *certConfig) logf(format string, args ...any) {
+	if cfg.Name != "" {
+		format = "[" + cfg.Name + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// validate checks that the options make sense together.
+func (cfg *certConfig) validate() error {
+	err := cfg.validateKey()
+	if err != nil {
+		return err
+	}
+	if cfg.PKCS11Module == "" && cfg.KeyFile == "" && cfg.CombinedFile == "" && cfg.DERKeyFile == "" && cfg.P12File == "" {
+		return fmt.Errorf("You must specify at least one of --key, --combined, --der-key or --p12 to save the private key")
+	}
+	if cfg.CertFile == "" && cfg.ChainFile == "" && cfg.CombinedFile == "" && cfg.DERCertFile == "" && cfg.P12File == "" {
+		return fmt.Errorf("You must specify at least one of --cert, --chain, --combined, --der-cert or --p12 to save the certificate")
+	}
+	if cfg.P12File != "" && cfg.P12Password == nil {
+		return fmt.Errorf("--p12 requires --p12-password-file")
+	}
+	return nil
+}
+
+// validateKey checks the options that concern the private key and file ownership.
+func (cfg *certConfig) validateKey() error {
+	if cfg.PKCS11Module != "" {
+		if cfg.KeyFile != "" || cfg.CombinedFile != "" || cfg.DERKeyFile != "" || cfg.P12File != "" {
+			return fmt.Errorf("The private key stays on the PKCS#11 token, so --key, --combined, --der-key and --p12 cannot be used with --pkcs11-module")
+		}
+	}
+	if cfg.EncryptKey && cfg.Passphrase == nil {
+		return fmt.Errorf("--encrypt-key requires --key-passphrase-file")
+	}
+	if cfg.EncryptKey && cfg.DERKeyFile != "" {
+		return fmt.Errorf("--der-key is never encrypted, so it cannot be used with --encrypt-key")
+	}
+	_, _, err := lookupOwner(cfg.Owner, cfg.Group)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// run makes sure the certificate files exist and have more than renewBefore left, requesting a
+// new certificate if they don't. It does not run the deploy hook. If the server fails, the result
+// is returned along with the error.
+func (cfg *certConfig) run(renewBefore time.Duration) (*runResult, error) {
+	unlock, err := cfg.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	key, err := cfg.loadKey(true)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+
+	result, err := cfg.newResult(key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, ok, err := cfg.checkExistingCertificate(key.Signer.Public(), result.Hostname, renewBefore)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cfg.logf("Existing certificate is valid until %s", leaf.NotAfter.Format(time.RFC3339))
+		result.NotBefore, result.NotAfter = leaf.NotBefore, leaf.NotAfter
+		return result, nil
+	}
+
+	csrPEM, err := tlspage.GenerateCSRWithSigner(key.Signer, result.Hostname)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating CSR: %v", err)
+	}
+
+	client := cfg.client
+	if client == nil {
+		client = tlspage.NewClient(cfg.Origin)
+	}
+	certPEMs, err := client.CertFromCSR(context.Background(), csrPEM)
+	if err != nil {
+		// the hostname is still useful for reporting
+		return result, &serverError{err}
+	}
+
+	result.FilesWritten, err = cfg.saveCertificates(certPEMs, key.PEM, key.StoredPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Renewed = true
+	result.NotBefore, result.NotAfter, err = leafValidity(certPEMs)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// leafValidity returns the validity period of the first certificate in certPEMs.
+func leafValidity(certPEMs []string) (notBefore, notAfter time.Time, err error) {
+	block, _ := pem.Decode([]byte(certPEMs[0]))
+	if block == nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Error decoding certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Error parsing certificate: %v", err)
+	}
+	return leaf.NotBefore, leaf.NotAfter, nil
+}
+
+// renewalThreshold caps renewBefore at a third of the lifetime of a certificate valid from
+// notBefore to notAfter. Without the cap a --days as long as the certificate lasts would renew
+// it every time.
+func renewalThreshold(renewBefore time.Duration, notBefore, notAfter time.Time) time.Duration {
+	return min(renewBefore, notAfter.Sub(notBefore)/3)
+}
+
+// privateKey is the key for a certificate, as returned by certConfig.loadKey.
+type privateKey struct {
+	Signer    crypto.Signer
+	PEM       string // unencrypted PEM, or "" if the key is on a PKCS#11 token
+	StoredPEM string // PEM as written to key files, which may be encrypted
+	Generated bool   // the key is new and hasn't been written anywhere yet
+
+	close func()
+}
+
+// Close releases the PKCS#11 module, if any.
+func (key *privateKey) Close() {
+	if key.close != nil {
+		key.close()
+	}
+}
+
+// loadKey opens the PKCS#11 key, or reads the private key from the first output file that
+// holds one. If there is no key yet, a new one is generated if generate is set.
+func (cfg *certConfig) loadKey(generate bool) (*privateKey, error) {
+	if cfg.PKCS11Module != "" {
+		signer, err := openPKCS11Signer(cfg.PKCS11Module, cfg.PKCS11Token, cfg.PKCS11Key, cfg.PKCS11PIN)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening PKCS#11 key: %v", err)
+		}
+		return &privateKey{Signer: signer, close: func() { signer.Close() }}, nil
 	}
 
-	csrPEM, err := tlspage.GenerateCSR(privKeyPEM, hostname)
+	key := &privateKey{}
+	keyPEM, err := cfg.loadPrivateKey()
 	if err != nil {
-		log.Fatalf("Error generating CSR: %v", err)
+		return nil, fmt.Errorf("Error loading private key: %v", err)
+	}
+	if keyPEM == "" {
+		if !generate {
+			return nil, fmt.Errorf("No private key found; use the same key options as when the CSR was created")
+		}
+		keyPEM, err = tlspage.GenerateKeyWithType(cfg.KeyType)
+		if err != nil {
+			return nil, fmt.Errorf("Error generating private key: %v", err)
+		}
+		key.Generated = true
 	}
 
-	certPEMs, err := tlspage.GetCertificate(csrPEM, *origin)
+	key.PEM, key.StoredPEM, err = unlockPrivateKey(keyPEM, cfg.Passphrase, cfg.EncryptKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading private key: %v", err)
+	}
+	key.Signer, err = tlspage.ParsePrivateKey(key.PEM)
 	if err != nil {
-		log.Fatalf("Error fetching certificate from server: %v", err)
+		return nil, fmt.Errorf("Error loading private key: %v", err)
 	}
+	return key, nil
+}
 
-	saveCertificates(certPEMs, privKeyPEM, outCert, outFullChain, outKey, outCombined)
+// newResult returns a runResult with the hostnames for key filled in.
+func (cfg *certConfig) newResult(key *privateKey) (*runResult, error) {
+	hostname, err := tlspage.HostnameFromPublicKey(key.Signer.Public(), cfg.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating hostname: %v", err)
+	}
 
-	fmt.Println(hostname)
+	result := &runResult{Hostname: hostname, DisplayName: hostname}
+	if cfg.IP != "" {
+		result.DisplayName, err = hostnameForIP(hostname, cfg.IP)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --ip: %v", err)
+		}
+	}
+	return result, nil
 }
 
-func validateOutputFiles(outKey, outCombined, outCert, outFullChain *string) {
-	if *outKey == "" && *outCombined == "" {
-		log.Fatal("You must specify at least one of --key or --combined to save the private key")
+func hostnameForIP(hostname, addr string) (string, error) {
+	if strings.Contains(addr, "%") {
+		return "", fmt.Errorf("%s has a zone ID, which cannot be represented in DNS", addr)
 	}
-	if *outCert == "" && *outFullChain == "" && *outCombined == "" {
-		log.Fatal("You must specify at least one of --cert, --chain, or --combined to save the certificate")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("%s is not an IP address", addr)
 	}
+	return tlspage.HostnameForIP(hostname, ip)
 }
 
-func loadOrGeneratePrivateKey(outKey, outCombined *string) (string, error) {
-	for _, filename := range []string{*outKey, *outCombined} {
+// loadPrivateKey returns the private key from the first existing output file that holds one,
+// or "" if there is none.
+func (cfg *certConfig) loadPrivateKey() (string, error) {
+	for _, filename := range []string{cfg.KeyFile, cfg.CombinedFile} {
 		if filename == "" {
 			continue
 		}
@@ -76,10 +417,11 @@ func loadOrGeneratePrivateKey(outKey, outCombined *string) (string, error) {
 			return "", fmt.Errorf("error reading private key file: %v", err)
 		}
 
-		// parse as PEM and return the first PRIVATE KEY block
+		// parse as PEM and return the first private key block (PKCS#8, SEC1, PKCS#1, OpenSSH
+		// or encrypted PKCS#8)
 		block, rest := pem.Decode(privKeyPEM)
 		for block != nil {
-			if block.Type == "PRIVATE KEY" {
+			if strings.HasSuffix(block.Type, "PRIVATE KEY") {
 				return string(pem.EncodeToMemory(block)), nil
 			}
 			block, rest = pem.Decode(rest)
@@ -89,77 +431,170 @@ func loadOrGeneratePrivateKey(outKey, outCombined *string) (string, error) {
 		}
 		return "", fmt.Errorf("no valid private key found in file %s", filename)
 	}
-
-	privKeyPEM, err := tlspage.GenerateKey()
-	if err != nil {
-		return "", fmt.Errorf("failed to generate private key: %v", err)
+	if cfg.DERKeyFile != "" {
+		privKeyPEM, err := loadDERPrivateKey(cfg.DERKeyFile)
+		if err != nil || privKeyPEM != "" {
+			return privKeyPEM, err
+		}
 	}
-	return privKeyPEM, nil
+	if cfg.P12File != "" {
+		privKeyPEM, err := loadPKCS12PrivateKey(cfg.P12File, cfg.P12Password)
+		if err != nil || privKeyPEM != "" {
+			return privKeyPEM, err
+		}
+	}
+	return "", nil
 }
 
-func checkExistingCertificate(outCert, outFullChain, outCombined *string, requireDays *int) bool {
-	for _, filename := range []string{*outCert, *outFullChain, *outCombined} {
-		if filename == "" {
-			continue
-		}
-		certData, err := os.ReadFile(filename)
-		if os.IsNotExist(err) {
-			continue
+// unlockPrivateKey returns the key in a form the tlspage package can use, and the form it should
+// be stored in on disk. Keys that are already encrypted stay encrypted. Plaintext keys are
+// encrypted if encrypt is set.
+func unlockPrivateKey(keyPEM string, passphrase []byte, encrypt bool) (privKeyPEM, storedKeyPEM string, err error) {
+	if tlspage.IsEncryptedPrivateKey(keyPEM) {
+		if passphrase == nil {
+			return "", "", fmt.Errorf("private key is encrypted, use --key-passphrase-file")
 		}
+		privKeyPEM, err = tlspage.DecryptPrivateKey(keyPEM, passphrase)
 		if err != nil {
-			log.Fatalf("Error reading certificate file: %v", err)
+			return "", "", err
 		}
+		return privKeyPEM, keyPEM, nil
+	}
 
-		remaining := certData
-		for {
-			var block *pem.Block
-			block, remaining = pem.Decode(remaining)
-			if block == nil {
-				break
-			}
-			if block.Type != "CERTIFICATE" {
-				continue
-			}
-			cert, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				log.Fatalf("Error parsing certificate: %v", err)
-			}
-			requireTime := time.Duration(*requireDays) * 24 * time.Hour
-			if time.Until(cert.NotAfter) > requireTime && *requireDays > 0 {
-				log.Printf("Existing certificate is valid until %s", cert.NotAfter.Format(time.RFC3339))
-				return true
-			}
+	if encrypt {
+		storedKeyPEM, err = tlspage.EncryptPrivateKey(keyPEM, passphrase)
+		if err != nil {
+			return "", "", err
 		}
+		return keyPEM, storedKeyPEM, nil
 	}
-	return false
+	return keyPEM, keyPEM, nil
 }
 
-func saveCertificates(certPEMs []string, privKeyPEM string, outCert, outFullChain, outKey, outCombined *string) {
-	if *outCert != "" {
-		err := os.WriteFile(*outCert, []byte(certPEMs[0]), 0644)
+// readPassphrase reads a passphrase from a file, ignoring a trailing newline.
+func readPassphrase(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return nil, fmt.Errorf("%s is empty", filename)
+	}
+	return []byte(passphrase), nil
+}
+
+// checkExistingCertificate looks at the leaf certificate in each certificate output file. If
+// they all exist, are for pub and hostname, and have more than renewBefore left (capped by
+// renewalThreshold if cfg.capRenewal is set) it returns the one that expires first and true. A
+// renewBefore of zero or less means the certificate is always renewed.
+func (cfg *certConfig) checkExistingCertificate(pub crypto.PublicKey, hostname string, renewBefore time.Duration) (leaf *x509.Certificate, ok bool, err error) {
+	if renewBefore <= 0 {
+		return nil, false, nil
+	}
+
+	files := []struct {
+		name   string
+		format fileFormat
+	}{
+		{cfg.CertFile, formatPEM},
+		{cfg.ChainFile, formatPEM},
+		{cfg.CombinedFile, formatPEM},
+		{cfg.DERCertFile, formatDER},
+		{cfg.P12File, formatPKCS12},
+	}
+	for _, file := range files {
+		if file.name == "" {
+			continue
+		}
+		cert, err := cfg.readLeafCertificate(file.name, file.format)
 		if err != nil {
-			log.Fatalf("Error writing certificate file: %v", err)
+			return nil, false, err
 		}
-	}
-	if *outFullChain != "" {
-		err := os.WriteFile(*outFullChain, []byte(joinPEMs(certPEMs)), 0644)
+		// a missing file or one that is about to expire needs a new certificate
+		if cert == nil {
+			return nil, false, nil
+		}
+		threshold := renewBefore
+		if cfg.capRenewal {
+			threshold = renewalThreshold(renewBefore, cert.NotBefore, cert.NotAfter)
+		}
+		if time.Until(cert.NotAfter) <= threshold {
+			return nil, false, nil
+		}
+		// so does one for another key or origin, say after the key file was replaced
+		err = leafMatchesKey(cert, pub, hostname)
 		if err != nil {
-			log.Fatalf("Error writing full-chain file: %v", err)
+			cfg.logf("Replacing certificate in %s: %v", file.name, err)
+			return nil, false, nil
+		}
+		if leaf == nil || cert.NotAfter.Before(leaf.NotAfter) {
+			leaf = cert
 		}
 	}
-	if *outKey != "" {
-		err := os.WriteFile(*outKey, []byte(privKeyPEM), 0600)
+	return leaf, leaf != nil, nil
+}
+
+// leafMatchesKey checks that cert is for pub and that its only name is "*."+hostname. The
+// hostname is derived from pub and the origin, so this also catches a certificate from another
+// origin.
+func leafMatchesKey(cert *x509.Certificate, pub crypto.PublicKey, hostname string) error {
+	if !publicKeysEqual(cert.PublicKey, pub) {
+		return fmt.Errorf("certificate is for a different private key")
+	}
+	expected := "*." + hostname
+	if len(cert.DNSNames) != 1 || !strings.EqualFold(cert.DNSNames[0], expected) {
+		return fmt.Errorf("certificate names %v do not match expected %s", cert.DNSNames, expected)
+	}
+	return nil
+}
+
+// saveCertificates writes every output file and returns their names. privKeyPEM is the
+// unencrypted key, used for the DER and PKCS#12 files, and storedKeyPEM is the key as it is
+// written to PEM files.
+func (cfg *certConfig) saveCertificates(certPEMs []string, privKeyPEM, storedKeyPEM string) ([]string, error) {
+	var files []outputFile
+	if cfg.CertFile != "" {
+		files = append(files, outputFile{cfg.CertFile, "certificate file", []byte(certPEMs[0]), cfg.CertMode})
+	}
+	if cfg.ChainFile != "" {
+		files = append(files, outputFile{cfg.ChainFile, "full-chain file", []byte(joinPEMs(certPEMs)), cfg.CertMode})
+	}
+	if cfg.KeyFile != "" {
+		files = append(files, outputFile{cfg.KeyFile, "private key file", []byte(storedKeyPEM), cfg.KeyMode})
+	}
+	if cfg.CombinedFile != "" {
+		combined := storedKeyPEM + joinPEMs(certPEMs)
+		files = append(files, outputFile{cfg.CombinedFile, "combined file", []byte(combined), cfg.KeyMode})
+	}
+	if cfg.DERCertFile != "" {
+		block, _ := pem.Decode([]byte(certPEMs[0]))
+		files = append(files, outputFile{cfg.DERCertFile, "DER certificate file", block.Bytes, cfg.CertMode})
+	}
+	if cfg.DERKeyFile != "" {
+		der, err := marshalDERPrivateKey(privKeyPEM)
 		if err != nil {
-			log.Fatalf("Error writing private key file: %v", err)
+			return nil, fmt.Errorf("Error encoding DER private key: %v", err)
 		}
+		files = append(files, outputFile{cfg.DERKeyFile, "DER private key file", der, cfg.KeyMode})
 	}
-	if *outCombined != "" {
-		combined := privKeyPEM + joinPEMs(certPEMs)
-		err := os.WriteFile(*outCombined, []byte(combined), 0600)
+	if cfg.P12File != "" {
+		p12, err := marshalPKCS12(privKeyPEM, certPEMs, cfg.P12Password, cfg.P12Legacy)
 		if err != nil {
-			log.Fatalf("Error writing combined file: %v", err)
+			return nil, fmt.Errorf("Error encoding PKCS#12 file: %v", err)
 		}
+		files = append(files, outputFile{cfg.P12File, "PKCS#12 file", p12, cfg.KeyMode})
+	}
+
+	err := cfg.writeFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
 	}
+	return names, nil
 }
 
 func joinPEMs(pems []string) string {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9072997/tlspage"
+)
+
+// newTestCertificate generates a key and returns it with its base name under origin and a
+// self-signed certificate for "*."+hostname that was issued now and lasts for lifetime.
+func newTestCertificate(t *testing.T, origin string, lifetime time.Duration) (keyPEM, hostname string, certPEMs []string) {
+	t.Helper()
+	keyPEM, err := tlspage.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, err = tlspage.Hostname(keyPEM, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPEM, hostname, []string{newTestLeaf(t, keyPEM, "*."+hostname, time.Now(), lifetime)}
+}
+
+// newTestLeaf returns a PEM certificate for keyPEM with a single DNS name.
+func newTestLeaf(t *testing.T, keyPEM, dnsName string, notBefore time.Time, lifetime time.Duration) string {
+	t.Helper()
+	key, err := tlspage.ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore = notBefore.Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func parseTestCertificate(t *testing.T, certPEM string) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode([]byte(certPEM))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestLeafMatchesKey(t *testing.T) {
+	keyPEM, hostname, certPEMs := newTestCertificate(t, "tls.page", 90*24*time.Hour)
+	key, err := tlspage.ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyPEM, otherHostname, otherCertPEMs := newTestCertificate(t, "tls.page", 90*24*time.Hour)
+	otherOriginHostname, err := tlspage.Hostname(keyPEM, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extraName := parseTestCertificate(t, certPEMs[0])
+	extraName.DNSNames = append(extraName.DNSNames, "www.example.com")
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		hostname string
+		wantErr  bool
+	}{
+		{"match", parseTestCertificate(t, certPEMs[0]), hostname, false},
+		{"upper case name", parseTestCertificate(t, newTestLeaf(t, keyPEM, "*."+strings.ToUpper(hostname), time.Now(), time.Hour)), hostname, false},
+		{"other key", parseTestCertificate(t, otherCertPEMs[0]), hostname, true},
+		{"other key's hostname", parseTestCertificate(t, newTestLeaf(t, otherKeyPEM, "*."+hostname, time.Now(), time.Hour)), hostname, true},
+		{"other hostname", parseTestCertificate(t, certPEMs[0]), otherHostname, true},
+		{"other origin", parseTestCertificate(t, certPEMs[0]), otherOriginHostname, true},
+		{"not a wildcard", parseTestCertificate(t, newTestLeaf(t, keyPEM, hostname, time.Now(), time.Hour)), hostname, true},
+		{"extra name", extraName, hostname, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := leafMatchesKey(tt.cert, key.Public(), tt.hostname)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("leafMatchesKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckExistingCertificate(t *testing.T) {
+	const day = 24 * time.Hour
+	keyPEM, hostname, certPEMs := newTestCertificate(t, "tls.page", 90*day)
+	key, err := tlspage.ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, otherCertPEMs := newTestCertificate(t, "tls.page", 90*day)
+	now := time.Now()
+	expiring := newTestLeaf(t, keyPEM, "*."+hostname, now.Add(-80*day), 90*day)
+	shortLived := newTestLeaf(t, keyPEM, "*."+hostname, now, 6*day)
+	oldShortLived := newTestLeaf(t, keyPEM, "*."+hostname, now.Add(-5*day), 6*day)
+	halfway := newTestLeaf(t, keyPEM, "*."+hostname, now.Add(-45*day), 90*day)
+
+	tests := []struct {
+		name        string
+		cert        string // "" for no file
+		chain       string
+		renewBefore time.Duration
+		capRenewal  bool
+		wantOK      bool
+	}{
+		{"valid", certPEMs[0], certPEMs[0], 30 * day, false, true},
+		{"always renew", certPEMs[0], certPEMs[0], 0, false, false},
+		{"missing file", certPEMs[0], "", 30 * day, false, false},
+		{"expiring", certPEMs[0], expiring, 30 * day, false, false},
+		{"other key", certPEMs[0], otherCertPEMs[0], 30 * day, false, false},
+		{"no certificate in file", certPEMs[0], keyPEM, 30 * day, false, false},
+		// without the cap renewBefore is used as given, even if it is most of the lifetime
+		{"long renewBefore", certPEMs[0], halfway, 60 * day, false, false},
+		{"long renewBefore capped", certPEMs[0], halfway, 60 * day, true, true},
+		{"short-lived", shortLived, shortLived, 30 * day, false, false},
+		// renewBefore is longer than the certificate lasts, so a third of its lifetime is used
+		{"short-lived capped", shortLived, shortLived, 30 * day, true, true},
+		{"short-lived capped with less than a third left", shortLived, oldShortLived, 30 * day, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := &certConfig{
+				CertFile:   filepath.Join(dir, "cert.pem"),
+				ChainFile:  filepath.Join(dir, "chain.pem"),
+				capRenewal: tt.capRenewal,
+			}
+			for filename, data := range map[string]string{cfg.CertFile: tt.cert, cfg.ChainFile: tt.chain} {
+				if data != "" {
+					writeTestFile(t, filename, data)
+				}
+			}
+
+			leaf, ok, err := cfg.checkExistingCertificate(key.Public(), hostname, tt.renewBefore)
+			if err != nil {
+				t.Fatalf("checkExistingCertificate() error = %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("checkExistingCertificate() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && leaf.NotAfter.After(parseTestCertificate(t, tt.chain).NotAfter) {
+				t.Errorf("checkExistingCertificate() returned a leaf expiring %s, not the earliest", leaf.NotAfter)
+			}
+		})
+	}
+
+	// a file that can't be parsed is an error rather than a reason to overwrite it
+	dir := t.TempDir()
+	cfg := &certConfig{DERCertFile: filepath.Join(dir, "cert.der")}
+	writeTestFile(t, cfg.DERCertFile, "not DER")
+	_, _, err = cfg.checkExistingCertificate(key.Public(), hostname, 30*day)
+	if err == nil {
+		t.Errorf("checkExistingCertificate() with a corrupt DER file error = nil, want an error")
+	}
+}
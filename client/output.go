@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+)
+
+// outputFile is one file written by saveCertificates.
+type outputFile struct {
+	Name        string
+	Description string // for error messages, e.g. "certificate file"
+	Data        []byte
+	Mode        os.FileMode
+}
+
+// writeFiles writes each file to a temporary file next to it, and only once all of them have
+// been written renames them into place. If a rename fails, the files already replaced are put
+// back, so an error or full disk leaves the previous set of files intact instead of a new
+// certificate next to an old key or a truncated file. With cfg.Backup the previous files are
+// kept as <name>.bak.
+func (cfg *certConfig) writeFiles(files []outputFile) (err error) {
+	uid, gid, err := lookupOwner(cfg.Owner, cfg.Group)
+	if err != nil {
+		return err
+	}
+
+	var backups, replacements []*replacement
+	defer func() {
+		all := slices.Concat(backups, replacements)
+		if err != nil {
+			// in reverse, in case a name was replaced twice
+			for i := len(all) - 1; i >= 0; i-- {
+				all[i].undo()
+			}
+		}
+		for _, r := range all {
+			r.cleanup()
+		}
+	}()
+
+	for _, file := range files {
+		temp, err := writeTemp(file.Name, file.Data, file.Mode, uid, gid)
+		if err != nil {
+			return fmt.Errorf("Error writing %s: %v", file.Description, err)
+		}
+		replacements = append(replacements, &replacement{temp: temp, name: file.Name})
+	}
+
+	if cfg.Backup {
+		for _, file := range files {
+			// a missing file removes the stale backup from an older set of files
+			backup, err := backupTemp(file.Name, uid, gid)
+			if err != nil {
+				return fmt.Errorf("Error backing up %s: %v", file.Description, err)
+			}
+			backups = append(backups, &replacement{temp: backup, name: file.Name + ".bak"})
+		}
+	}
+
+	// backups go in first so that <name>.bak is never newer than <name>
+	for _, r := range slices.Concat(backups, replacements) {
+		err = r.apply()
+		if err != nil {
+			return fmt.Errorf("Error replacing %s: %v", r.name, err)
+		}
+	}
+	return nil
+}
+
+// replacement renames temp over name, or removes name if temp is "". The previous contents of
+// name are kept in old until cleanup, so the change can be undone.
+type replacement struct {
+	temp string
+	name string
+
+	old   string // link to the previous name, or "" if it didn't exist
+	saved bool   // old has been set, so undo knows what to put back
+}
+
+func (r *replacement) apply() error {
+	old, err := linkOld(r.name)
+	if err != nil {
+		return err
+	}
+	r.old = old
+	r.saved = true
+
+	if r.temp == "" {
+		err = os.Remove(r.name)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	return os.Rename(r.temp, r.name)
+}
+
+// undo puts back what name held before apply.
+func (r *replacement) undo() {
+	if !r.saved {
+		return
+	}
+	if r.old == "" {
+		os.Remove(r.name)
+		return
+	}
+	err := os.Rename(r.old, r.name)
+	if err == nil {
+		r.old = ""
+	}
+}
+
+// cleanup removes the temporary file if it wasn't used, and the saved previous contents.
+func (r *replacement) cleanup() {
+	if r.temp != "" {
+		os.Remove(r.temp)
+	}
+	if r.old != "" {
+		os.Remove(r.old)
+	}
+}
+
+// linkOld makes a hard link to filename under a temporary name next to it, so it can be renamed
+// back after filename is replaced. Where hard links aren't supported it makes a copy instead.
+// If filename doesn't exist it returns "".
+func linkOld(filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for range 10 {
+		old := filepath.Join(
+			filepath.Dir(filename),
+			fmt.Sprintf(".%s.%d.old", filepath.Base(filename), rand.Uint32()),
+		)
+		err = os.Link(filename, old)
+		if err == nil {
+			return old, nil
+		}
+		if !os.IsExist(err) {
+			break
+		}
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return writeTemp(filename, data, info.Mode().Perm(), -1, -1)
+}
+
+// writeTemp writes data to a new temporary file in the same directory as filename, so it can
+// be renamed over it, and returns its name.
+func writeTemp(filename string, data []byte, mode os.FileMode, uid, gid int) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil && (uid != -1 || gid != -1) {
+		err = f.Chown(uid, gid)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// backupTemp copies filename to a temporary file that will become <filename>.bak. If filename
+// doesn't exist it returns "".
+func backupTemp(filename string, uid, gid int) (string, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	return writeTemp(filename+".bak", data, info.Mode().Perm(), uid, gid)
+}
+
+// lookupOwner resolves --owner and --group, which may be names or numeric IDs. Unset values
+// are returned as -1, which leaves them unchanged.
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" && group == "" {
+		return uid, gid, nil
+	}
+	if runtime.GOOS == "windows" {
+		return 0, 0, fmt.Errorf("--owner and --group are not supported on Windows")
+	}
+
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err == nil {
+			uid, err = strconv.Atoi(u.Uid)
+		} else {
+			// like chown(1), accept IDs that aren't in the user database
+			uid, err = strconv.Atoi(owner)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", owner)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err == nil {
+			gid, err = strconv.Atoi(g.Gid)
+		} else {
+			gid, err = strconv.Atoi(group)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown group %q", group)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// readDir returns the contents of every file in dir by name.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			files[entry.Name()] = "<dir>"
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func writeTestFile(t *testing.T, name, data string) {
+	t.Helper()
+	err := os.WriteFile(name, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	chain := filepath.Join(dir, "chain.pem")
+	writeTestFile(t, cert, "old cert")
+	writeTestFile(t, key, "old key")
+	writeTestFile(t, chain+".bak", "stale chain")
+
+	cfg := &certConfig{Backup: true}
+	err := cfg.writeFiles([]outputFile{
+		{cert, "certificate file", []byte("new cert"), 0644},
+		{key, "private key file", []byte("new key"), 0600},
+		{chain, "full-chain file", []byte("new chain"), 0644},
+	})
+	if err != nil {
+		t.Fatalf("writeFiles() error = %v", err)
+	}
+
+	want := map[string]string{
+		"cert.pem":     "new cert",
+		"cert.pem.bak": "old cert",
+		"key.pem":      "new key",
+		"key.pem.bak":  "old key",
+		"chain.pem":    "new chain",
+	}
+	got := readDir(t, dir)
+	for name, data := range want {
+		if got[name] != data {
+			t.Errorf("%s = %q, want %q", name, got[name], data)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("writeFiles() left %d files, want %d: %v", len(got), len(want), got)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("key.pem mode = %v, want 0600", info.Mode().Perm())
+		}
+	}
+}
+
+func TestWriteFilesRollback(t *testing.T) {
+	for _, backup := range []bool{false, true} {
+		dir := t.TempDir()
+		cert := filepath.Join(dir, "cert.pem")
+		key := filepath.Join(dir, "key.pem")
+		chain := filepath.Join(dir, "chain.pem")
+		combined := filepath.Join(dir, "combined.pem")
+		writeTestFile(t, cert, "old cert")
+		writeTestFile(t, key, "old key")
+
+		// a non-empty directory in the way of the last file makes its rename fail after the
+		// others have been replaced
+		err := os.Mkdir(combined, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, filepath.Join(combined, "file"), "")
+		before := readDir(t, dir)
+
+		cfg := &certConfig{Backup: backup}
+		err = cfg.writeFiles([]outputFile{
+			{cert, "certificate file", []byte("new cert"), 0644},
+			{key, "private key file", []byte("new key"), 0600},
+			{chain, "full-chain file", []byte("new chain"), 0644},
+			{combined, "combined file", []byte("new combined"), 0600},
+		})
+		if err == nil {
+			t.Fatalf("writeFiles() with backup %v error = nil, want an error", backup)
+		}
+
+		after := readDir(t, dir)
+		for name, data := range before {
+			if after[name] != data {
+				t.Errorf("backup %v: %s = %q after a failed write, want %q", backup, name, after[name], data)
+			}
+		}
+		for name := range after {
+			if _, ok := before[name]; !ok {
+				t.Errorf("backup %v: %s left behind after a failed write", backup, name)
+			}
+		}
+	}
+}
+
+func TestModeFlags(t *testing.T) {
+	tests := []struct {
+		args     []string
+		certMode os.FileMode
+		keyMode  os.FileMode
+	}{
+		{nil, 0644, 0600},
+		{[]string{"--mode", "0640"}, 0644, 0640},
+		{[]string{"--cert-mode", "0600"}, 0600, 0600},
+		{[]string{"--mode", "0660", "--cert-mode", "0664"}, 0664, 0660},
+	}
+	for _, tt := range tests {
+		cfg := newCertConfig()
+		fs := flag.NewFlagSet("client", flag.ContinueOnError)
+		addKeyFlags(fs, cfg)
+		err := fs.Parse(tt.args)
+		if err != nil {
+			t.Fatalf("Parse(%v) error = %v", tt.args, err)
+		}
+		if cfg.CertMode != tt.certMode || cfg.KeyMode != tt.keyMode {
+			t.Errorf("Parse(%v) modes = %v, %v, want %v, %v", tt.args, cfg.CertMode, cfg.KeyMode, tt.certMode, tt.keyMode)
+		}
+	}
+
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addKeyFlags(fs, newCertConfig())
+	if fs.Parse([]string{"--cert-mode", "0999"}) == nil {
+		t.Errorf("Parse(--cert-mode 0999) error = nil, want an error")
+	}
+}
+
+func TestSaveCertificatesModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+	dir := t.TempDir()
+	cfg := newCertConfig()
+	cfg.CertMode = 0640
+	cfg.KeyMode = 0400
+	cfg.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.ChainFile = filepath.Join(dir, "chain.pem")
+	cfg.KeyFile = filepath.Join(dir, "key.pem")
+	cfg.CombinedFile = filepath.Join(dir, "combined.pem")
+
+	keyPEM, _, certPEMs := newTestCertificate(t, "example.com", 90*24*time.Hour)
+	_, err := cfg.saveCertificates(certPEMs, keyPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]os.FileMode{
+		cfg.CertFile:     0640,
+		cfg.ChainFile:    0640,
+		cfg.KeyFile:      0400,
+		cfg.CombinedFile: 0400,
+	}
+	for name, mode := range want {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s mode = %v, want %v", filepath.Base(name), info.Mode().Perm(), mode)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 v3.0 values, which not every version of the pkcs11 package defines
+const (
+	ckkECEdwards = 0x00000040
+	ckmEdDSA     = 0x00001057
+)
+
+var (
+	oidPublicKeyECDSA   = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidPublicKeyEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// DigestInfo prefixes for PKCS#1 v1.5 signatures (RFC 8017 section 9.2)
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Signer is a crypto.Signer for a private key that stays on a PKCS#11 token.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	keyType uint
+	pub     crypto.PublicKey
+
+	// a session can only run one operation at a time
+	mu sync.Mutex
+}
+
+// openPKCS11Signer loads the PKCS#11 module, logs in to the token with the given label and finds
+// the private key with the given label.
+func openPKCS11Signer(module, tokenLabel, keyLabel, pin string) (*pkcs11Signer, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", module)
+	}
+	err := ctx.Initialize()
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %v", err)
+	}
+
+	s := &pkcs11Signer{ctx: ctx}
+	err = s.open(tokenLabel, keyLabel, pin)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pkcs11Signer) open(tokenLabel, keyLabel, pin string) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("failed to list PKCS#11 slots: %v", err)
+	}
+	var slot uint
+	found := false
+	for _, id := range slots {
+		info, err := s.ctx.GetTokenInfo(id)
+		if err != nil {
+			continue
+		}
+		// labels are padded with spaces to 32 bytes
+		if strings.TrimRight(info.Label, " \x00") == tokenLabel {
+			slot = id
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("no PKCS#11 token with label %q", tokenLabel)
+	}
+
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open PKCS#11 session: %v", err)
+	}
+	if pin != "" {
+		err = s.ctx.Login(s.session, pkcs11.CKU_USER, pin)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			return fmt.Errorf("failed to log in to PKCS#11 token: %v", err)
+		}
+	}
+
+	s.key, err = s.findObject([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+	})
+	if err != nil {
+		return fmt.Errorf("private key %q: %v", keyLabel, err)
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, s.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read private key attributes: %v", err)
+	}
+	s.keyType = uint(bytesToUint(attrs[0].Value))
+	id := attrs[1].Value
+
+	switch s.keyType {
+	case pkcs11.CKK_RSA:
+		s.pub, err = s.rsaPublicKey()
+	case pkcs11.CKK_EC, ckkECEdwards:
+		// the private key object doesn't have the point, so find the matching public key
+		template := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		}
+		if len(id) > 0 {
+			template[1] = pkcs11.NewAttribute(pkcs11.CKA_ID, id)
+		}
+		var pubKey pkcs11.ObjectHandle
+		pubKey, err = s.findObject(template)
+		if err != nil {
+			return fmt.Errorf("public key for %q: %v", keyLabel, err)
+		}
+		s.pub, err = s.ecPublicKey(pubKey)
+	default:
+		return fmt.Errorf("unsupported PKCS#11 key type 0x%x", s.keyType)
+	}
+	return err
+}
+
+// findObject returns the only object that matches template.
+func (s *pkcs11Signer) findObject(template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	err := s.ctx.FindObjectsInit(s.session, template)
+	if err != nil {
+		return 0, err
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 2)
+	finalErr := s.ctx.FindObjectsFinal(s.session)
+	if err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch len(objects) {
+	case 0:
+		return 0, fmt.Errorf("not found")
+	case 1:
+		return objects[0], nil
+	default:
+		return 0, fmt.Errorf("more than one object matches")
+	}
+}
+
+func (s *pkcs11Signer) rsaPublicKey() (crypto.PublicKey, error) {
+	attrs, err := s.ctx.GetAttributeValue(s.session, s.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RSA public key: %v", err)
+	}
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("RSA public exponent is too large")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0].Value),
+		E: int(e.Int64()),
+	}, nil
+}
+
+// ecPublicKey builds a SubjectPublicKeyInfo from the EC parameters and point of a public key
+// object and lets the x509 package parse it.
+func (s *pkcs11Signer) ecPublicKey(pubKey pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := s.ctx.GetAttributeValue(s.session, pubKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EC public key: %v", err)
+	}
+	params, point := attrs[0].Value, attrs[1].Value
+
+	// CKA_EC_POINT should be a DER OCTET STRING, but some tokens return the raw point
+	var unwrapped []byte
+	rest, err := asn1.Unmarshal(point, &unwrapped)
+	if err == nil && len(rest) == 0 {
+		point = unwrapped
+	}
+
+	var algo pkix.AlgorithmIdentifier
+	if s.keyType == ckkECEdwards {
+		algo.Algorithm = oidPublicKeyEd25519
+		if len(point) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("only Ed25519 is supported for EdDSA keys")
+		}
+	} else {
+		algo.Algorithm = oidPublicKeyECDSA
+		algo.Parameters = asn1.RawValue{FullBytes: params}
+	}
+	spki, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: algo,
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse EC public key: %v", err)
+	}
+	return pub, nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	var data []byte
+	switch s.keyType {
+	case pkcs11.CKK_RSA:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, fmt.Errorf("RSA-PSS is not supported")
+		}
+		prefix, ok := pkcs1Prefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function %v", opts.HashFunc())
+		}
+		mechanism = pkcs11.CKM_RSA_PKCS
+		data = append(bytes.Clone(prefix), digest...)
+	case pkcs11.CKK_EC:
+		mechanism = pkcs11.CKM_ECDSA
+		data = digest
+	case ckkECEdwards:
+		if opts.HashFunc() != 0 {
+			return nil, fmt.Errorf("Ed25519ph is not supported")
+		}
+		mechanism = ckmEdDSA
+		data = digest
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start PKCS#11 signature: %v", err)
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 signature failed: %v", err)
+	}
+
+	if s.keyType != pkcs11.CKK_EC {
+		return sig, nil
+	}
+	// PKCS#11 returns r || s, but crypto.Signer users expect ASN.1
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, fmt.Errorf("PKCS#11 returned a malformed ECDSA signature")
+	}
+	half := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(sig[:half]),
+		S: new(big.Int).SetBytes(sig[half:]),
+	})
+}
+
+// Close logs out and unloads the PKCS#11 module.
+func (s *pkcs11Signer) Close() error {
+	if s.session != 0 {
+		s.ctx.Logout(s.session)
+		s.ctx.CloseSession(s.session)
+	}
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
+
+// bytesToUint decodes a CK_ULONG attribute, which is in host byte order.
+func bytesToUint(b []byte) uint64 {
+	switch len(b) {
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b))
+	case 8:
+		return binary.NativeEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+//go:build !cgo
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// pkcs11Signer is unavailable without cgo, which is needed to load PKCS#11 modules.
+type pkcs11Signer struct {
+	crypto.Signer
+}
+
+func openPKCS11Signer(module, tokenLabel, keyLabel, pin string) (*pkcs11Signer, error) {
+	return nil, fmt.Errorf("this build does not support PKCS#11 (it was built without cgo)")
+}
+
+func (s *pkcs11Signer) Close() error {
+	return nil
+}
@@ -0,0 +1,198 @@
+//go:build cgo
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/9072997/tlspage"
+	"github.com/miekg/pkcs11"
+)
+
+// findSoftHSM returns the path to the SoftHSM v2 module, or "" if it isn't installed.
+func findSoftHSM() string {
+	candidates := []string{
+		os.Getenv("SOFTHSM2_MODULE"),
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib64/pkcs11/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	}
+	for _, path := range candidates {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// setupSoftHSM creates a token in a temporary directory and generates an ECDSA P-256 and an
+// RSA 2048 key pair on it.
+func setupSoftHSM(t *testing.T, module, tokenLabel, pin string) {
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	err := os.Mkdir(tokenDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err = os.WriteFile(conf, []byte("directories.tokendir = "+tokenDir+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("failed to load %s", module)
+	}
+	defer ctx.Destroy()
+	err = ctx.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no SoftHSM slots: %v", err)
+	}
+	err = ctx.InitToken(slots[0], "so-pin", tokenLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SoftHSM renumbers the slot once the token is initialized
+	slots, err = ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slot uint
+	for _, id := range slots {
+		info, err := ctx.GetTokenInfo(id)
+		if err == nil && strings.TrimRight(info.Label, " ") == tokenLabel {
+			slot = id
+		}
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+	err = ctx.Login(session, pkcs11.CKU_SO, "so-pin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ctx.InitPIN(session, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Logout(session)
+	err = ctx.Login(session, pkcs11.CKU_USER, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Logout(session)
+
+	p256, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := []struct {
+		label     string
+		mechanism uint
+		public    []*pkcs11.Attribute
+	}{
+		{"ecdsa", pkcs11.CKM_EC_KEY_PAIR_GEN, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, p256),
+		}},
+		{"rsa", pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}},
+	}
+	for i, kp := range keyPairs {
+		id := []byte{byte(i + 1)}
+		public := append(kp.public,
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, kp.label),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		)
+		private := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, kp.label),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		}
+		_, _, err = ctx.GenerateKeyPair(
+			session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(kp.mechanism, nil)},
+			public,
+			private,
+		)
+		if err != nil {
+			t.Fatalf("failed to generate %s key: %v", kp.label, err)
+		}
+	}
+}
+
+func TestPKCS11Signer(t *testing.T) {
+	module := findSoftHSM()
+	if module == "" {
+		t.Skip("SoftHSM v2 is not installed (set SOFTHSM2_MODULE to its path)")
+	}
+	setupSoftHSM(t, module, "tlspage-test", "1234")
+
+	for _, keyLabel := range []string{"ecdsa", "rsa"} {
+		t.Run(keyLabel, func(t *testing.T) {
+			signer, err := openPKCS11Signer(module, "tlspage-test", keyLabel, "1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer signer.Close()
+
+			hostname, err := tlspage.HostnameFromPublicKey(signer.Public(), "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			csrPEM, err := tlspage.GenerateCSRWithSigner(signer, hostname)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, _ := pem.Decode([]byte(csrPEM))
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = csr.CheckSignature()
+			if err != nil {
+				t.Errorf("CSR signature is invalid: %v", err)
+			}
+			got, err := tlspage.HostnameFromCSR(csr, "example.com")
+			if err != nil || got != hostname {
+				t.Errorf("HostnameFromCSR() = %v, %v, want %v", got, err, hostname)
+			}
+		})
+	}
+
+	_, err := openPKCS11Signer(module, "tlspage-test", "missing", "1234")
+	if err == nil {
+		t.Errorf("openPKCS11Signer() found a key that doesn't exist")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"text/tabwriter"
+	"time"
+
+	"github.com/9072997/tlspage"
+)
+
+// exit codes, so that scripts can tell what happened without parsing the output
+const (
+	exitUnchanged  = 0
+	exitLocalError = 1 // also what log.Fatal exits with
+	// 2 is used by the flag package for usage errors
+	exitServerError = 3
+	exitRenewed     = 4
+)
+
+// serverError is a failure to get a certificate from the server, including network errors, as
+// opposed to a problem with local files or options.
+type serverError struct {
+	Err error
+}
+
+func (e *serverError) Error() string {
+	return "Error fetching certificate from server: " + e.Err.Error()
+}
+
+func (e *serverError) Unwrap() error {
+	return e.Err
+}
+
+// report is the --output json description of one certificate.
+type report struct {
+	Name         string     `json:"name,omitempty"` // only in --config mode
+	Status       string     `json:"status"`         // "unchanged", "renewed" or "error"
+	Hostname     string     `json:"hostname,omitempty"`
+	DisplayName  string     `json:"display_name,omitempty"`
+	URLs         []string   `json:"urls,omitempty"`
+	NotAfter     *time.Time `json:"not_after,omitempty"`
+	FilesWritten []string   `json:"files_written"`
+	Error        string     `json:"error,omitempty"`
+	ErrorType    string     `json:"error_type,omitempty"`  // "local" or "server"
+	StatusCode   int        `json:"status_code,omitempty"` // HTTP status of a server error
+}
+
+// newReport describes the outcome of a run. result may be nil if err is set, and both may be
+// set if the certificate was renewed but the deploy hook failed.
+func (cfg *certConfig) newReport(result *runResult, err error) *report {
+	r := &report{Name: cfg.Name, Status: "unchanged", FilesWritten: []string{}}
+	if result != nil {
+		if result.Renewed {
+			r.Status = "renewed"
+		}
+		r.Hostname = result.Hostname
+		r.DisplayName = result.DisplayName
+		r.URLs = cfg.urls(result.Hostname)
+		if !result.NotAfter.IsZero() {
+			r.NotAfter = &result.NotAfter
+		}
+		for _, filename := range result.FilesWritten {
+			r.FilesWritten = append(r.FilesWritten, absPath(filename))
+		}
+	}
+
+	if err != nil {
+		r.Status = "error"
+		r.Error = err.Error()
+		r.ErrorType = "local"
+		var srvErr *serverError
+		if errors.As(err, &srvErr) {
+			r.ErrorType = "server"
+			var httpErr *tlspage.ServerError
+			if errors.As(err, &httpErr) {
+				r.StatusCode = httpErr.StatusCode
+			}
+		}
+	}
+	return r
+}
+
+// urls returns "https://<ip-label>.<base>" URLs for --ip, or for every interface address if it
+// isn't set. Errors are ignored since the URLs are only informational.
+func (cfg *certConfig) urls(hostname string) []string {
+	urls, _ := tlspage.URLsForIPs(hostname, cfg.ips(), 443)
+	return urls
+}
+
+// ips returns --ip, or every interface address if it isn't set.
+func (cfg *certConfig) ips() []net.IP {
+	if cfg.IP != "" {
+		return []net.IP{net.ParseIP(cfg.IP)}
+	}
+	ips, _ := tlspage.InterfaceAddrs()
+	return ips
+}
+
+func (r *report) exitCode() int {
+	switch {
+	case r.ErrorType == "local":
+		return exitLocalError
+	case r.ErrorType == "server":
+		return exitServerError
+	case r.Status == "renewed":
+		return exitRenewed
+	default:
+		return exitUnchanged
+	}
+}
+
+// exitCode returns the most important exit code of several reports: a local error, then a
+// server error, then renewed.
+func exitCode(reports []*report) int {
+	code := exitUnchanged
+	for _, r := range reports {
+		c := r.exitCode()
+		switch {
+		case c == exitLocalError:
+			return c
+		case c == exitServerError:
+			code = c
+		case c == exitRenewed && code == exitUnchanged:
+			code = c
+		}
+	}
+	return code
+}
+
+// printReport prints a single certificate's outcome: the hostname as text, or the report as
+// JSON. The caller logs any error.
+func printReport(w io.Writer, r *report, jsonOutput bool) {
+	if jsonOutput {
+		writeJSON(w, r)
+	} else if r.DisplayName != "" && r.Error == "" {
+		fmt.Fprintln(w, r.DisplayName)
+	}
+}
+
+// printReports prints the outcome of several certificates as a table or a JSON array.
+func printReports(w io.Writer, reports []*report, jsonOutput bool) {
+	if jsonOutput {
+		writeJSON(w, reports)
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tHOSTNAME\tEXPIRES")
+	for _, r := range reports {
+		hostname, expires := "-", "-"
+		if r.DisplayName != "" {
+			hostname = r.DisplayName
+		}
+		if r.NotAfter != nil {
+			expires = r.NotAfter.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, r.Status, hostname, expires)
+	}
+	tw.Flush()
+}
+
+func writeJSON(w io.Writer, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
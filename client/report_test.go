@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/9072997/tlspage"
+	"github.com/9072997/tlspage/tlspagetest"
+)
+
+func TestNewReport(t *testing.T) {
+	cfg := &certConfig{Name: "web", IP: "192.168.1.10"}
+	const hostname = "9b7d8f4b4f45183149c1b666d08d1f8c.bfcd0704a087908e509c39b1c2b98cc5.tls.page"
+	unchanged := &runResult{Hostname: hostname, DisplayName: hostname, NotAfter: time.Now()}
+	renewed := &runResult{Hostname: hostname, DisplayName: hostname, Renewed: true, FilesWritten: []string{"cert.pem"}}
+	httpErr := &tlspage.ServerError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+
+	tests := []struct {
+		name       string
+		result     *runResult
+		err        error
+		status     string
+		errorType  string
+		statusCode int
+		exitCode   int
+	}{
+		{"unchanged", unchanged, nil, "unchanged", "", 0, exitUnchanged},
+		{"renewed", renewed, nil, "renewed", "", 0, exitRenewed},
+		{"local error", nil, errors.New("Error reading key.pem"), "error", "local", 0, exitLocalError},
+		{"server error", unchanged, &serverError{httpErr}, "error", "server", http.StatusServiceUnavailable, exitServerError},
+		{"network error", nil, &serverError{errors.New("connection refused")}, "error", "server", 0, exitServerError},
+		{"deploy hook failed", renewed, errors.New("Deploy hook failed: exit status 1"), "error", "local", 0, exitLocalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := cfg.newReport(tt.result, tt.err)
+			if r.Status != tt.status || r.ErrorType != tt.errorType || r.StatusCode != tt.statusCode {
+				t.Errorf("newReport() = status %q, error type %q, status code %d, want %q, %q, %d", r.Status, r.ErrorType, r.StatusCode, tt.status, tt.errorType, tt.statusCode)
+			}
+			if got := r.exitCode(); got != tt.exitCode {
+				t.Errorf("exitCode() = %d, want %d", got, tt.exitCode)
+			}
+			if tt.result != nil && (len(r.URLs) != 1 || r.URLs[0] != "https://192-168-1-10."+hostname) {
+				t.Errorf("newReport() URLs = %v, want the one for --ip", r.URLs)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	unchanged := &report{Status: "unchanged"}
+	renewed := &report{Status: "renewed"}
+	server := &report{Status: "error", ErrorType: "server"}
+	local := &report{Status: "error", ErrorType: "local"}
+
+	tests := []struct {
+		reports []*report
+		want    int
+	}{
+		{nil, exitUnchanged},
+		{[]*report{unchanged, unchanged}, exitUnchanged},
+		{[]*report{unchanged, renewed}, exitRenewed},
+		{[]*report{renewed, server, unchanged}, exitServerError},
+		{[]*report{local, renewed, server}, exitLocalError},
+		{[]*report{server, local}, exitLocalError},
+	}
+	for _, tt := range tests {
+		var statuses []string
+		for _, r := range tt.reports {
+			statuses = append(statuses, r.Status+"/"+r.ErrorType)
+		}
+		if got := exitCode(tt.reports); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", statuses, got, tt.want)
+		}
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	srv := tlspagetest.NewServer("")
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := newCertConfig()
+	cfg.Origin = srv.Origin
+	cfg.IP = "127.0.0.1"
+	cfg.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.KeyFile = filepath.Join(dir, "key.pem")
+	cfg.client = srv.Client()
+	renewBefore := time.Duration(cfg.Days) * 24 * time.Hour
+
+	runReport := func() *report {
+		t.Helper()
+		result, err := cfg.run(renewBefore)
+		return cfg.newReport(result, err)
+	}
+
+	r := runReport()
+	if r.exitCode() != exitRenewed {
+		t.Fatalf("first run exit code = %d (%s), want %d", r.exitCode(), r.Error, exitRenewed)
+	}
+	if len(r.FilesWritten) != 2 || r.NotAfter == nil {
+		t.Errorf("first run report = %+v, want two files and an expiry", r)
+	}
+	var buf bytes.Buffer
+	printReport(&buf, r, true)
+	var decoded map[string]any
+	err := json.Unmarshal(buf.Bytes(), &decoded)
+	if err != nil || decoded["status"] != "renewed" || decoded["hostname"] != r.Hostname {
+		t.Errorf("printReport() JSON = %s, %v", buf.String(), err)
+	}
+
+	r = runReport()
+	if r.exitCode() != exitUnchanged {
+		t.Errorf("second run exit code = %d (%s), want %d", r.exitCode(), r.Error, exitUnchanged)
+	}
+
+	err = os.Remove(cfg.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.FailNext(1, http.StatusBadRequest)
+	r = runReport()
+	if r.exitCode() != exitServerError || r.StatusCode != http.StatusBadRequest {
+		t.Errorf("run with a server error exit code = %d, status code %d (%s), want %d, %d", r.exitCode(), r.StatusCode, r.Error, exitServerError, http.StatusBadRequest)
+	}
+
+	err = os.WriteFile(cfg.KeyFile, []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = runReport()
+	if r.exitCode() != exitLocalError {
+		t.Errorf("run with a broken key file exit code = %d (%s), want %d", r.exitCode(), r.Error, exitLocalError)
+	}
+}
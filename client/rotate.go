@@ -0,0 +1,238 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/9072997/tlspage"
+)
+
+// rotateReport is the --output json description of a rotation.
+type rotateReport struct {
+	Old       *report           `json:"old"`
+	New       *report           `json:"new"`
+	Hostnames map[string]string `json:"hostnames"` // old hostname to new, including IP hostnames
+	Promoted  bool              `json:"promoted"`
+}
+
+// runRotate handles "rotate". The hostname is derived from the key, so a new key means new URLs
+// and the old key has to keep working until everything pointing at it has been updated. rotate
+// renews the existing certificate if it is due, then generates a new key and gets a certificate
+// for it, writing the new files next to the old ones (key.pem becomes key.new.pem). It prints
+// the old and new hostnames and runs --rotate-hook so bookmarks, CNAMEs or service discovery
+// can be updated. With --promote the new files then replace the old ones.
+//
+// Running rotate again reuses the new key if its files are still there, so a failed hook can be
+// retried, and "rotate --promote" can be run later to finish a rotation.
+func runRotate(args []string) {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	cfg := newCertConfig()
+	addKeyFlags(fs, cfg)
+	addOutputFlags(fs, cfg)
+	suffix := fs.String("new-suffix", "new", "Name the new files by inserting this before the extension")
+	rotateHook := fs.String("rotate-hook", "", "Shell command to run once the new files are written (see TLSPAGE_* and TLSPAGE_OLD_* environment variables)")
+	promote := fs.Bool("promote", false, "After --rotate-hook succeeds, replace the old files with the new ones and run --deploy-hook")
+	jsonOutput := outputFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rotate [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Generates a new key and certificate next to the existing ones, and prints each old\n")
+		fmt.Fprintf(fs.Output(), "hostname followed by the new one. Give the same flags as when the certificate was\n")
+		fmt.Fprintf(fs.Output(), "created.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PKCS11Module != "" {
+		log.Fatal("rotate writes the new key to files, so it cannot be used with --pkcs11-module")
+	}
+	if *suffix == "" || strings.ContainsAny(*suffix, `/\`) {
+		log.Fatal("--new-suffix must be a non-empty file name part")
+	}
+	keyPEM, err := cfg.loadPrivateKey()
+	if err != nil {
+		log.Fatalf("Error loading private key: %v", err)
+	}
+	if keyPEM == "" {
+		log.Fatal("No private key to rotate; get a certificate without \"rotate\" first")
+	}
+
+	newCfg := cfg.withSuffix(*suffix)
+	renewBefore := time.Duration(cfg.Days) * 24 * time.Hour
+	r := &rotateReport{}
+
+	// the old certificate has to stay valid until the rotation is finished
+	oldResult, err := cfg.run(renewBefore)
+	if err == nil && oldResult.Renewed {
+		err = cfg.runDeployHook(oldResult)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	r.Old = cfg.newReport(oldResult, err)
+	if err != nil {
+		r.finish(os.Stdout, *jsonOutput)
+	}
+
+	newResult, err := newCfg.run(renewBefore)
+	if err == nil {
+		r.Hostnames = cfg.hostnameMap(oldResult.Hostname, newResult.Hostname)
+		if *rotateHook != "" {
+			err = runHook(*rotateHook, rotateHookEnv(cfg, oldResult, newCfg, newResult, r.Hostnames))
+			if err != nil {
+				err = fmt.Errorf("Rotate hook failed: %v", err)
+			}
+		}
+	}
+	if err == nil && *promote {
+		newResult.FilesWritten, err = cfg.promote(newCfg)
+		if err == nil {
+			r.Promoted = true
+			cfg.logf("Replaced the files for %s with the ones for %s", oldResult.Hostname, newResult.Hostname)
+			err = cfg.runDeployHook(newResult)
+		}
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	r.New = newCfg.newReport(newResult, err)
+	r.finish(os.Stdout, *jsonOutput)
+}
+
+// finish prints the report and exits.
+func (r *rotateReport) finish(w io.Writer, jsonOutput bool) {
+	reports := []*report{r.Old}
+	if r.New != nil {
+		reports = append(reports, r.New)
+	}
+
+	if jsonOutput {
+		writeJSON(w, r)
+	} else {
+		fmt.Fprint(w, formatHostnameMap(r.Hostnames))
+	}
+	os.Exit(exitCode(reports))
+}
+
+// withSuffix returns a copy of cfg whose output files have suffix inserted before their
+// extension. The copy has no deploy hook since its files aren't in use yet.
+func (cfg *certConfig) withSuffix(suffix string) *certConfig {
+	newCfg := *cfg
+	for _, filename := range []*string{
+		&newCfg.CertFile, &newCfg.ChainFile, &newCfg.KeyFile, &newCfg.CombinedFile,
+		&newCfg.DERCertFile, &newCfg.DERKeyFile, &newCfg.P12File,
+	} {
+		if *filename != "" {
+			ext := filepath.Ext(*filename)
+			*filename = strings.TrimSuffix(*filename, ext) + "." + suffix + ext
+		}
+	}
+	newCfg.DeployHook = ""
+	return &newCfg
+}
+
+// promote replaces cfg's files with newCfg's, which must be a copy from withSuffix, and removes
+// newCfg's files. It returns the names of the replaced files.
+func (cfg *certConfig) promote(newCfg *certConfig) ([]string, error) {
+	unlock, err := cfg.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	unlockNew, err := newCfg.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlockNew()
+
+	oldNames := []string{
+		cfg.CertFile, cfg.ChainFile, cfg.KeyFile, cfg.CombinedFile,
+		cfg.DERCertFile, cfg.DERKeyFile, cfg.P12File,
+	}
+	newNames := []string{
+		newCfg.CertFile, newCfg.ChainFile, newCfg.KeyFile, newCfg.CombinedFile,
+		newCfg.DERCertFile, newCfg.DERKeyFile, newCfg.P12File,
+	}
+	var files []outputFile
+	var names []string
+	for i, name := range oldNames {
+		if name == "" {
+			continue
+		}
+		data, err := os.ReadFile(newNames[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error reading new file: %v", err)
+		}
+		info, err := os.Stat(newNames[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error reading new file: %v", err)
+		}
+		files = append(files, outputFile{name, name, data, info.Mode().Perm()})
+		names = append(names, name)
+	}
+
+	err = cfg.writeFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range oldNames {
+		if name != "" {
+			os.Remove(newNames[i])
+		}
+	}
+	return names, nil
+}
+
+// hostnameMap maps the old base name, and the old hostname for each address from ips, to the
+// new ones.
+func (cfg *certConfig) hostnameMap(oldHostname, newHostname string) map[string]string {
+	hostnames := map[string]string{oldHostname: newHostname}
+	for _, ip := range cfg.ips() {
+		oldIPHostname, err := tlspage.HostnameForIP(oldHostname, ip)
+		if err != nil {
+			continue
+		}
+		newIPHostname, err := tlspage.HostnameForIP(newHostname, ip)
+		if err != nil {
+			continue
+		}
+		hostnames[oldIPHostname] = newIPHostname
+	}
+	return hostnames
+}
+
+// formatHostnameMap returns one "old new" line per hostname, sorted by the old hostname.
+func formatHostnameMap(hostnames map[string]string) string {
+	var sb strings.Builder
+	for _, oldHostname := range slices.Sorted(maps.Keys(hostnames)) {
+		fmt.Fprintf(&sb, "%s %s\n", oldHostname, hostnames[oldHostname])
+	}
+	return sb.String()
+}
+
+// rotateHookEnv describes the new certificate with the usual TLSPAGE_* variables and the old one
+// with TLSPAGE_OLD_* variables. TLSPAGE_HOSTNAME_MAP has the output of formatHostnameMap.
+func rotateHookEnv(cfg *certConfig, oldResult *runResult, newCfg *certConfig, newResult *runResult, hostnames map[string]string) []string {
+	env := newCfg.hookEnv(newResult)
+	for _, v := range cfg.hookEnv(oldResult) {
+		if !strings.HasPrefix(v, "TLSPAGE_ORIGIN=") {
+			env = append(env, strings.Replace(v, "TLSPAGE_", "TLSPAGE_OLD_", 1))
+		}
+	}
+	return append(env, "TLSPAGE_HOSTNAME_MAP="+formatHostnameMap(hostnames))
+}
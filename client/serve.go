@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/9072997/tlspage"
+)
+
+// runServe handles "serve". It gets a certificate with a tlspage.Manager, which keeps it
+// renewed, and serves a directory or proxies to a local HTTP server over HTTPS.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	origin := fs.String("origin", "tls.page", "Server from which to get the certificate")
+	dir := fs.String("dir", "", "Serve the files in this directory")
+	proxy := fs.String("proxy", "", "Proxy requests to this HTTP server (ex: http://localhost:3000)")
+	addr := fs.String("listen", ":443", "Address to listen on")
+	cacheDir := fs.String("cache", defaultServeCache(), "Directory to keep the private key and certificate in, so the hostname stays the same across restarts")
+	keyType := tlspage.KeyTypeECDSAP256
+	fs.Func("key-type", "Type of private key to generate if none exists (default ecdsa-p256)", func(s string) error {
+		var err error
+		keyType, err = tlspage.ParseKeyType(s)
+		return err
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve --dir PATH | --proxy URL [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Serves HTTPS with a key-pinned certificate that is renewed automatically, and prints\n")
+		fmt.Fprintf(fs.Output(), "a URL for every local address.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || (*dir == "") == (*proxy == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	handler, err := newServeHandler(*dir, *proxy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := &tlspage.Manager{
+		Cache:   tlspage.DirCache(*cacheDir),
+		Origin:  *origin,
+		KeyType: keyType,
+	}
+	ln, urls, err := tlspage.Listen(*addr, &tlspage.ListenOptions{Manager: m})
+	if errors.Is(err, os.ErrPermission) {
+		log.Fatalf("%v (try --listen :8443)", err)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hostname, err := m.Hostname(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Serving https://%s on %s", hostname, ln.Addr())
+	for _, u := range urls {
+		fmt.Println(u)
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	log.Fatal(srv.Serve(ln))
+}
+
+// newServeHandler returns a file server for dir, or a reverse proxy to proxy if dir is "".
+func newServeHandler(dir, proxy string) (http.Handler, error) {
+	if dir != "" {
+		return http.FileServer(http.Dir(dir)), nil
+	}
+
+	target, err := url.Parse(proxy)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("Invalid --proxy: %s is not an http:// or https:// URL", proxy)
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+	}, nil
+}
+
+// defaultServeCache returns the directory serve keeps its key in when --cache isn't given.
+func defaultServeCache() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "tlspage-serve"
+	}
+	return filepath.Join(dir, "tlspage", "serve")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// renewal happens up to this long before the --days threshold, so a fleet of clients
+	// started at the same time doesn't hit the server at once
+	maxJitter = 12 * time.Hour
+
+	// even when nothing is due, check the files this often in case they were changed
+	maxCheckInterval = 24 * time.Hour
+
+	minRetryDelay = time.Minute
+	maxRetryDelay = 6 * time.Hour
+
+	deployHookTimeout = 5 * time.Minute
+)
+
+// runMu keeps certificates watched from a config file from renewing at the same time. PKCS#11
+// modules in particular don't like being loaded and unloaded concurrently.
+var runMu sync.Mutex
+
+// watch runs cfg forever, renewing the certificate before it has fewer than cfg.Days left, or
+// a third of its lifetime if that is shorter. Failures, including a failed deploy hook, are
+// retried with exponential backoff.
+func watch(cfg *certConfig) {
+	threshold := time.Duration(cfg.Days) * 24 * time.Hour
+	jitter := rand.N(maxJitter)
+	retryDelay := minRetryDelay
+	warnedLifetime := false
+	cfg.capRenewal = true
+
+	// set when the certificate was renewed but the deploy hook hasn't succeeded yet
+	var hookPending *runResult
+
+	for {
+		runMu.Lock()
+		var result *runResult
+		var err error
+		if hookPending != nil {
+			result = hookPending
+		} else {
+			result, err = cfg.run(threshold + jitter)
+			if err == nil && result.Renewed {
+				cfg.logf(
+					"Renewed certificate for %s, valid until %s",
+					result.DisplayName,
+					result.NotAfter.Format(time.RFC3339),
+				)
+				hookPending = result
+			}
+		}
+		if hookPending != nil {
+			err = cfg.runDeployHook(hookPending)
+			if err == nil {
+				hookPending = nil
+			}
+		}
+		runMu.Unlock()
+
+		var wait time.Duration
+		if err != nil {
+			cfg.logf("%v (retrying in %s)", err, retryDelay)
+			wait = retryDelay
+			retryDelay = min(retryDelay*2, maxRetryDelay)
+		} else {
+			lifetime := result.NotAfter.Sub(result.NotBefore)
+			if threshold > lifetime/3 && !warnedLifetime {
+				cfg.logf(
+					"Warning: days (%d) is more than a third of the certificate lifetime (%s), renewing when a third of it is left instead",
+					cfg.Days,
+					lifetime.Round(time.Hour),
+				)
+				warnedLifetime = true
+			}
+			retryDelay = minRetryDelay
+			jitter = rand.N(maxJitter)
+			renewBefore := renewalThreshold(threshold+jitter, result.NotBefore, result.NotAfter)
+			wait = time.Until(result.NotAfter.Add(-renewBefore))
+			wait = max(min(wait, maxCheckInterval), minRetryDelay)
+		}
+
+		cfg.logf("Next check at %s", time.Now().Add(wait).Format(time.RFC3339))
+		time.Sleep(wait)
+	}
+}
+
+// runDeployHook runs cfg.DeployHook (if set) with a shell, passing details of the new
+// certificate in TLSPAGE_* environment variables. Unused file variables are set to an empty
+// string.
+func (cfg *certConfig) runDeployHook(result *runResult) error {
+	if cfg.DeployHook == "" {
+		return nil
+	}
+	err := runHook(cfg.DeployHook, cfg.hookEnv(result))
+	if err != nil {
+		return fmt.Errorf("Deploy hook failed: %v", err)
+	}
+	return nil
+}
+
+// hookEnv returns the TLSPAGE_* variables describing result and cfg's output files.
+func (cfg *certConfig) hookEnv(result *runResult) []string {
+	return []string{
+		"TLSPAGE_HOSTNAME=" + result.Hostname,
+		"TLSPAGE_DISPLAY_NAME=" + result.DisplayName,
+		"TLSPAGE_ORIGIN=" + cfg.Origin,
+		"TLSPAGE_NOT_AFTER=" + result.NotAfter.Format(time.RFC3339),
+		"TLSPAGE_CERT=" + absPath(cfg.CertFile),
+		"TLSPAGE_CHAIN=" + absPath(cfg.ChainFile),
+		"TLSPAGE_KEY=" + absPath(cfg.KeyFile),
+		"TLSPAGE_COMBINED=" + absPath(cfg.CombinedFile),
+		"TLSPAGE_DER_CERT=" + absPath(cfg.DERCertFile),
+		"TLSPAGE_DER_KEY=" + absPath(cfg.DERKeyFile),
+		"TLSPAGE_P12=" + absPath(cfg.P12File),
+	}
+}
+
+// runHook runs command with a shell, adding env to the environment. Its output goes to stderr
+// to keep stdout for the hostname.
+func runHook(command string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deployHookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdin = nil
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.Run()
+}
+
+// absPath makes filename absolute so hooks can change directory, leaving "" alone.
+func absPath(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return filename
+	}
+	return abs
+}
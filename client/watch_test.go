@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenewalThreshold(t *testing.T) {
+	const day = 24 * time.Hour
+	notBefore := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		renewBefore time.Duration
+		lifetime    time.Duration
+		want        time.Duration
+	}{
+		{"short of lifetime", 30 * day, 90 * day, 30 * day},
+		{"capped", 60 * day, 90 * day, 30 * day},
+		{"equal to lifetime", 7 * day, 7 * day, 7 * day / 3},
+		{"longer than lifetime", 30 * day, 6 * day, 2 * day},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renewalThreshold(tt.renewBefore, notBefore, notBefore.Add(tt.lifetime))
+			if got != tt.want {
+				t.Errorf("renewalThreshold(%s, lifetime %s) = %s, want %s", tt.renewBefore, tt.lifetime, got, tt.want)
+			}
+		})
+	}
+}
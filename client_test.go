@@ -0,0 +1,149 @@
+package tlspage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientRetry(t *testing.T) {
+	const hostname = "9b7d8f4b4f45183149c1b666d08d1f8c.bfcd0704a087908e509c39b1c2b98cc5.example.com"
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		attempts++
+		switch req.URL.Path {
+		case "/hostname-from-csr":
+			if attempts < 3 {
+				http.Error(resp, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			resp.Write([]byte(hostname))
+		default:
+			http.Error(resp, "CSR validation failed", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		HTTPClient: srv.Client(),
+		BaseURL:    srv.URL,
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+	}
+
+	got, err := c.HostnameFromCSR(context.Background(), "csr")
+	if err != nil {
+		t.Fatalf("HostnameFromCSR() error = %v", err)
+	}
+	if got != hostname {
+		t.Errorf("HostnameFromCSR() = %v, want %v", got, hostname)
+	}
+	if attempts != 3 {
+		t.Errorf("HostnameFromCSR() made %d attempts, want 3", attempts)
+	}
+
+	attempts = 0
+	_, err = c.CertFromCSR(context.Background(), "csr")
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("CertFromCSR() error = %v, want *ServerError with status 400", err)
+	}
+	if attempts != 1 {
+		t.Errorf("CertFromCSR() made %d attempts, want 1", attempts)
+	}
+}
+
+func TestClientRetryDroppedConnection(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		// drop the connection after the request has been read
+		conn, _, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		HTTPClient: srv.Client(),
+		BaseURL:    srv.URL,
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+	}
+
+	// the server may already be issuing a certificate, so a POST is not sent again
+	_, err := c.CertFromCSR(context.Background(), "csr")
+	if err == nil {
+		t.Fatal("CertFromCSR() error = nil, want an error")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("CertFromCSR() made %d attempts, want 1", n)
+	}
+
+	attempts.Store(0)
+	err = c.Status(context.Background())
+	if err == nil {
+		t.Fatal("Status() error = nil, want an error")
+	}
+	if n := attempts.Load(); n != 4 {
+		t.Errorf("Status() made %d attempts, want 4", n)
+	}
+
+	// a POST that never reached the server can be sent again
+	srv.Close()
+	var dials atomic.Int32
+	c.HTTPClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	_, err = c.HostnameFromCSR(context.Background(), "csr")
+	if err == nil {
+		t.Fatal("HostnameFromCSR() error = nil, want an error")
+	}
+	if n := dials.Load(); n != 4 {
+		t.Errorf("HostnameFromCSR() dialed %d times, want 4", n)
+	}
+}
+
+func TestClientRetryAfterCap(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			resp.Header().Set("Retry-After", "3600")
+			http.Error(resp, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		resp.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		HTTPClient:    srv.Client(),
+		BaseURL:       srv.URL,
+		Retries:       1,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := c.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status() error = %v, want the Retry-After delay capped at MaxRetryDelay", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Status() made %d attempts, want 2", attempts)
+	}
+}
@@ -9,9 +9,13 @@ require (
 	github.com/hlandau/buildinfo v0.0.0-20161112115716-337a29b54997
 	github.com/hlandau/xlog v1.0.0
 	github.com/miekg/dns v1.1.66
+	github.com/miekg/pkcs11 v1.1.1
 	golang.org/x/crypto v0.38.0
+	golang.org/x/sync v0.15.0
+	golang.org/x/sys v0.33.0
 	gopkg.in/hlandau/madns.v2 v2.0.2
 	gopkg.in/yaml.v2 v2.4.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
@@ -27,8 +31,6 @@ require (
 	github.com/stretchr/testify v1.10.0 // indirect
 	golang.org/x/mod v0.25.0 // indirect
 	golang.org/x/net v0.40.0 // indirect
-	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
 	golang.org/x/tools v0.33.0 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.4.0 // indirect
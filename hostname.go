@@ -0,0 +1,215 @@
+package tlspage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// PinnedHostname is a parsed key-pinned hostname of the form "[ip-label.]{32 chars}.{32 chars}.origin".
+type PinnedHostname struct {
+	// IPLabel is the optional leading label encoding an IP address (ex: "192-168-1-10").
+	// It is empty if the name is a bare base name.
+	IPLabel string
+
+	// IP is the address decoded from IPLabel, or nil if there is no IP label.
+	IP net.IP
+
+	// Fingerprint is the SHA-256 hash of the DER-encoded SubjectPublicKeyInfo.
+	Fingerprint []byte
+
+	// Origin is the domain the name is under (ex: "tls.page").
+	Origin string
+}
+
+// SPKIFingerprint returns the SHA-256 hash of the DER-encoded SubjectPublicKeyInfo of pub.
+func SPKIFingerprint(pub crypto.PublicKey) ([]byte, error) {
+	pkix, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %v", err)
+	}
+	hash := sha256.Sum256(pkix)
+	return hash[:], nil
+}
+
+// HostnameFromPublicKey calculates the key-pinned base name for a public key.
+// The format will be "{32 chars}.{32 chars}.origin".
+func HostnameFromPublicKey(pub crypto.PublicKey, origin string) (string, error) {
+	fingerprint, err := SPKIFingerprint(pub)
+	if err != nil {
+		return "", err
+	}
+	return baseName(fingerprint, origin), nil
+}
+
+// HostnameFromCertificate calculates the key-pinned base name for a certificate and checks that
+// every name in the certificate is the wildcard for that base name.
+func HostnameFromCertificate(cert *x509.Certificate, origin string) (string, error) {
+	hostname, err := HostnameFromPublicKey(cert.PublicKey, origin)
+	if err != nil {
+		return "", err
+	}
+
+	names := append([]string{}, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	err = checkPinnedNames(names, hostname)
+	if err != nil {
+		return "", fmt.Errorf("certificate %v", err)
+	}
+	if len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs) > 0 {
+		return "", fmt.Errorf("certificate contains non-DNS names")
+	}
+	return hostname, nil
+}
+
+// HostnameFromCSR calculates the key-pinned base name for a CSR and checks that every name in the
+// CSR is the wildcard for that base name. This is the same validation the server performs.
+func HostnameFromCSR(csr *x509.CertificateRequest, origin string) (string, error) {
+	hostname, err := HostnameFromPublicKey(csr.PublicKey, origin)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkPinnedNames(getCSRNames(csr), hostname)
+	if err != nil {
+		return "", fmt.Errorf("CSR %v", err)
+	}
+	return hostname, nil
+}
+
+// ParseHostname parses a key-pinned hostname under origin. The name may have a leading "*."
+// and a trailing ".". An optional leading IP label is decoded into IP.
+func ParseHostname(name, origin string) (*PinnedHostname, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	name = strings.TrimPrefix(name, "*.")
+	origin = strings.ToLower(strings.TrimSuffix(origin, "."))
+
+	labels, ok := strings.CutSuffix(name, "."+origin)
+	if !ok || origin == "" {
+		return nil, fmt.Errorf("hostname %s is not under %s", name, origin)
+	}
+
+	parts := strings.Split(labels, ".")
+	p := &PinnedHostname{Origin: origin}
+	switch len(parts) {
+	case 2:
+	case 3:
+		p.IPLabel = parts[0]
+		ip, err := ParseIPLabel(p.IPLabel)
+		if err != nil {
+			return nil, err
+		}
+		p.IP = ip
+		parts = parts[1:]
+	default:
+		return nil, fmt.Errorf("hostname %s does not have a key-pinned base name", name)
+	}
+
+	for _, part := range parts {
+		if len(part) != 32 {
+			return nil, fmt.Errorf("fingerprint label %s is not 32 characters", part)
+		}
+	}
+	fingerprint, err := hex.DecodeString(parts[0] + parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint in hostname %s: %v", name, err)
+	}
+	p.Fingerprint = fingerprint
+	return p, nil
+}
+
+// BaseName returns the key-pinned base name without the IP label.
+func (p *PinnedHostname) BaseName() string {
+	return baseName(p.Fingerprint, p.Origin)
+}
+
+// String returns the full hostname, including the IP label if there is one.
+func (p *PinnedHostname) String() string {
+	if p.IPLabel == "" {
+		return p.BaseName()
+	}
+	return p.IPLabel + "." + p.BaseName()
+}
+
+// VerifyPublicKey returns an error if pub does not match the fingerprint in the hostname.
+func (p *PinnedHostname) VerifyPublicKey(pub crypto.PublicKey) error {
+	fingerprint, err := SPKIFingerprint(pub)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(fingerprint, p.Fingerprint) {
+		return fmt.Errorf(
+			"public key fingerprint %x does not match hostname %s",
+			fingerprint,
+			p,
+		)
+	}
+	return nil
+}
+
+// VerifyCertificate returns an error if the certificate's public key does not match the
+// fingerprint in the hostname or the certificate is not valid for the hostname.
+func (p *PinnedHostname) VerifyCertificate(cert *x509.Certificate) error {
+	err := p.VerifyPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	if p.IPLabel != "" {
+		return cert.VerifyHostname(p.String())
+	}
+	// a wildcard does not match the bare base name, so look for it directly
+	if !slices.Contains(cert.DNSNames, "*."+p.BaseName()) {
+		return fmt.Errorf("certificate is not valid for *.%s", p.BaseName())
+	}
+	return nil
+}
+
+// baseName formats a fingerprint as a key-pinned base name.
+// DNS labels are limited to 63 characters, so use 2x32 labels.
+func baseName(fingerprint []byte, origin string) string {
+	s := hex.EncodeToString(fingerprint)
+	return s[:32] + "." + s[32:] + "." + origin
+}
+
+// checkPinnedNames returns an error unless names is non-empty and every name is "*."+hostname.
+func checkPinnedNames(names []string, hostname string) error {
+	expected := "*." + hostname
+	for _, name := range names {
+		if name != expected {
+			return fmt.Errorf("does not match expected hostname: %s", name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("does not contain any names")
+	}
+	return nil
+}
+
+func getCSRNames(csr *x509.CertificateRequest) []string {
+	var names []string
+
+	// Add the Common Name (CN) if it exists
+	if len(csr.Subject.CommonName) > 0 {
+		names = append(names, csr.Subject.CommonName)
+	}
+
+	// Add all Subject Alternative Names (SANs)
+	names = append(names, csr.DNSNames...)
+	names = append(names, csr.EmailAddresses...)
+	for _, ip := range csr.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
@@ -0,0 +1,70 @@
+package tlspage
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPLabel encodes an IP address as a single DNS label by replacing the separators with dashes
+// (ex: "192-168-1-10" or "fd00--1"). IPv6 addresses use the compressed form, with a 0 group
+// written out at either end so the label doesn't start or end with a dash (ex: "0--1" for ::1).
+// IPv4-mapped IPv6 addresses are encoded as IPv4.
+func IPLabel(ip net.IP) (string, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.ReplaceAll(ip4.String(), ".", "-"), nil
+	}
+	if len(ip) != net.IPv6len {
+		return "", fmt.Errorf("invalid IP address %v", ip)
+	}
+	label := strings.ReplaceAll(ip.String(), ":", "-")
+	if strings.HasPrefix(label, "-") {
+		label = "0" + label
+	}
+	if strings.HasSuffix(label, "-") {
+		label += "0"
+	}
+	return label, nil
+}
+
+// ParseIPLabel decodes a DNS label like "192-168-1-10" or "fd00--1" into an IP address.
+// IPv4 addresses are returned in their 4-byte form.
+func ParseIPLabel(label string) (net.IP, error) {
+	// try as IPv4
+	parsed := net.ParseIP(strings.ReplaceAll(label, "-", "."))
+	if parsed != nil {
+		return parsed.To4(), nil
+	}
+
+	// try as IPv6
+	parsed = net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+	if parsed != nil {
+		return parsed.To16(), nil
+	}
+
+	return nil, fmt.Errorf("label %s is not an IP address", label)
+}
+
+// HostnameForIP returns the hostname under the key-pinned base name that resolves to ip
+// (ex: "192-168-1-10.{32 chars}.{32 chars}.origin").
+func HostnameForIP(base string, ip net.IP) (string, error) {
+	label, err := IPLabel(ip)
+	if err != nil {
+		return "", err
+	}
+	return label + "." + strings.TrimPrefix(base, "*."), nil
+}
+
+// IPFromHostname is the inverse of HostnameForIP. It decodes the IP address from the first label
+// of hostname and returns it along with the remaining base name.
+func IPFromHostname(hostname string) (ip net.IP, base string, err error) {
+	label, base, ok := strings.Cut(strings.TrimSuffix(hostname, "."), ".")
+	if !ok {
+		return nil, "", fmt.Errorf("hostname %s has no base name", hostname)
+	}
+	ip, err = ParseIPLabel(label)
+	if err != nil {
+		return nil, "", err
+	}
+	return ip, base, nil
+}
@@ -17,9 +17,21 @@ func main() {
 	select {}
 }
 
-// GenerateKey generates a new ECDSA P-256 private key and returns it as a PEM-encoded string.
+// GenerateKey generates a new private key and returns it as a PEM-encoded string.
+// An optional key type (ex: "rsa-2048") may be given. The default is ECDSA P-256.
 func GenerateKey(this js.Value, args []js.Value) any {
-	pem, _ := tlspage.GenerateKey()
+	keyType := tlspage.KeyTypeECDSAP256
+	if len(args) > 0 && args[0].Type() == js.TypeString {
+		var err error
+		keyType, err = tlspage.ParseKeyType(args[0].String())
+		if err != nil {
+			return js.ValueOf("error: " + err.Error())
+		}
+	}
+	pem, err := tlspage.GenerateKeyWithType(keyType)
+	if err != nil {
+		return js.ValueOf("error: " + err.Error())
+	}
 	return js.ValueOf(pem)
 }
 
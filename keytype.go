@@ -0,0 +1,92 @@
+package tlspage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+)
+
+// KeyType identifies a key algorithm and size.
+type KeyType string
+
+const (
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeECDSAP384 KeyType = "ecdsa-p384"
+	KeyTypeRSA2048   KeyType = "rsa-2048"
+	KeyTypeRSA3072   KeyType = "rsa-3072"
+	KeyTypeRSA4096   KeyType = "rsa-4096"
+	KeyTypeEd25519   KeyType = "ed25519"
+)
+
+// KeyTypes lists every supported key type. The first entry is the default.
+var KeyTypes = []KeyType{
+	KeyTypeECDSAP256,
+	KeyTypeECDSAP384,
+	KeyTypeRSA2048,
+	KeyTypeRSA3072,
+	KeyTypeRSA4096,
+	KeyTypeEd25519,
+}
+
+// ParseKeyType parses a key type name such as "ecdsa-p256" or "rsa-2048".
+func ParseKeyType(s string) (KeyType, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, kt := range KeyTypes {
+		if string(kt) == s {
+			return kt, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %q", s)
+}
+
+// KeyTypeOf returns the key type of the given public key, or an error if the
+// key is not one of the supported types.
+func KeyTypeOf(pub crypto.PublicKey) (KeyType, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECDSAP256, nil
+		case elliptic.P384():
+			return KeyTypeECDSAP384, nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048, nil
+		case 3072:
+			return KeyTypeRSA3072, nil
+		case 4096:
+			return KeyTypeRSA4096, nil
+		}
+		return "", fmt.Errorf("unsupported RSA key size %d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("unsupported public key type %T", pub)
+}
+
+func generateSigner(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
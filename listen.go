@@ -0,0 +1,144 @@
+package tlspage
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ListenOptions configures Listen.
+type ListenOptions struct {
+	// Manager provides the certificate. If nil, a Manager with default settings is used,
+	// which generates a new key every time the program starts.
+	Manager *Manager
+}
+
+// Listen announces on the TCP address addr and returns a listener that serves TLS with the
+// managed certificate. It also returns "https://<ip-label>.<base>" URLs for the addresses the
+// listener is reachable at. If addr has no host or is "[::]", a URL is returned for every address
+// from InterfaceAddrs. An IPv4 host such as "0.0.0.0" listens on IPv4 only, and only IPv4 URLs
+// are returned.
+//
+// The certificate is obtained before Listen returns, so errors from the server are reported here
+// rather than during the first handshake.
+func Listen(addr string, opts *ListenOptions) (net.Listener, []string, error) {
+	var m *Manager
+	if opts != nil {
+		m = opts.Manager
+	}
+	if m == nil {
+		m = &Manager{}
+	}
+
+	ctx := context.Background()
+	_, err := m.Certificate(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, err := m.Hostname(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Go listens on both IPv4 and IPv6 for "0.0.0.0", which isn't what the caller asked for
+	network := "tcp"
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			network = "tcp4"
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	urls, err := listenerURLs(ln.Addr(), hostname)
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return tls.NewListener(ln, m.TLSConfig()), urls, nil
+}
+
+// InterfaceAddrs returns the global unicast addresses (including private ranges) of all network
+// interfaces. Loopback, link-local and multicast addresses are skipped.
+func InterfaceAddrs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// URLsForIPs returns an "https://<ip-label>.<base>" URL for each address. The port is omitted if
+// it is 443.
+func URLsForIPs(base string, ips []net.IP, port int) ([]string, error) {
+	var urls []string
+	for _, ip := range ips {
+		hostname, err := HostnameForIP(base, ip)
+		if err != nil {
+			return nil, err
+		}
+		if port != 443 {
+			hostname = net.JoinHostPort(hostname, strconv.Itoa(port))
+		}
+		urls = append(urls, "https://"+hostname)
+	}
+	return urls, nil
+}
+
+func listenerURLs(addr net.Addr, base string) ([]string, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected listener address type %T", addr)
+	}
+
+	ips := []net.IP{tcpAddr.IP}
+	if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		ifaceIPs, err := InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		ips = unspecifiedListenerIPs(tcpAddr.IP, ifaceIPs)
+	}
+	return URLsForIPs(base, ips, tcpAddr.Port)
+}
+
+// unspecifiedListenerIPs returns the interface addresses a listener on an unspecified address
+// is reachable at: all of them for "::" (which also accepts IPv4), or the IPv4 ones for
+// "0.0.0.0".
+func unspecifiedListenerIPs(listenIP net.IP, ifaceIPs []net.IP) []net.IP {
+	if listenIP == nil || listenIP.To4() == nil {
+		return ifaceIPs
+	}
+	var ips []net.IP
+	for _, ip := range ifaceIPs {
+		if ip.To4() != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,106 @@
+package tlspage_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/9072997/tlspage"
+	"github.com/9072997/tlspage/tlspagetest"
+)
+
+func TestURLsForIPs(t *testing.T) {
+	const base = "9b7d8f4b4f45183149c1b666d08d1f8c.bfcd0704a087908e509c39b1c2b98cc5.example.com"
+	ips := []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("fd00::1")}
+
+	got, err := tlspage.URLsForIPs(base, ips, 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://192-168-1-10." + base, "https://fd00--1." + base}
+	if !slices.Equal(got, want) {
+		t.Errorf("URLsForIPs() on 443 = %v, want %v", got, want)
+	}
+
+	got, err = tlspage.URLsForIPs(base, ips, 8443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"https://192-168-1-10." + base + ":8443", "https://fd00--1." + base + ":8443"}
+	if !slices.Equal(got, want) {
+		t.Errorf("URLsForIPs() on 8443 = %v, want %v", got, want)
+	}
+}
+
+func TestInterfaceAddrs(t *testing.T) {
+	ips, err := tlspage.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range ips {
+		if !ip.IsGlobalUnicast() {
+			t.Errorf("InterfaceAddrs() returned %v, which is not a global unicast address", ip)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	srv := tlspagetest.NewServer("")
+	defer srv.Close()
+	m := &tlspage.Manager{Client: srv.Client()}
+	defer m.Close()
+	opts := &tlspage.ListenOptions{Manager: m}
+
+	ln, urls, err := tlspage.Listen("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	if len(urls) != 1 || !strings.HasPrefix(urls[0], "https://127-0-0-1.") {
+		t.Fatalf("Listen() URLs = %v, want one for 127.0.0.1", urls)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+	u, err := url.Parse(urls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName: u.Hostname(),
+		RootCAs:    srv.Roots,
+	})
+	if err != nil {
+		t.Fatalf("handshake with %s failed: %v", u.Hostname(), err)
+	}
+	conn.Close()
+
+	// 0.0.0.0 only gets IPv4 URLs
+	ln4, urls, err := tlspage.Listen("0.0.0.0:0", opts)
+	if err != nil {
+		t.Fatalf("Listen() on 0.0.0.0 error = %v", err)
+	}
+	defer ln4.Close()
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, _, err := tlspage.IPFromHostname(u.Hostname())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.To4() == nil {
+			t.Errorf("Listen() on 0.0.0.0 returned IPv6 URL %s", rawURL)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package tlspage
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	managerKeyName  = "key.pem"
+	managerCertName = "cert.pem"
+)
+
+// Manager obtains and renews a certificate for a key-pinned hostname and serves it through
+// tls.Config.GetCertificate. It works like autocert.Manager, but the hostname is derived from the
+// key rather than being chosen up front.
+//
+//	m := &tlspage.Manager{Cache: tlspage.DirCache("/var/lib/myapp/tlspage")}
+//	srv := &http.Server{Addr: ":443", TLSConfig: m.TLSConfig()}
+//	srv.ListenAndServeTLS("", "")
+type Manager struct {
+	// Cache stores the private key and certificate chain. If nil, a MemCache is used,
+	// which means a new key (and hostname) every time the program starts.
+	Cache Cache
+
+	// Origin is the server to get certificates from. If empty, "tls.page" is used.
+	Origin string
+
+	// Client is used to request certificates. If nil, NewClient(Origin) is used.
+	Client *Client
+
+	// KeyType is the type of key generated when the cache has none. If empty, ECDSA P-256 is used.
+	KeyType KeyType
+
+	// RenewBefore is how long before expiry the certificate is renewed. If zero, 30 days is used.
+	RenewBefore time.Duration
+
+	mu         sync.Mutex
+	privKeyPEM string
+	hostname   string
+	cert       *tls.Certificate
+	renewTimer *time.Timer
+	closed     bool
+
+	obtaining *obtainCall // the request for a first certificate, if one is running
+	failures  int         // consecutive failures to get a first certificate
+	retryAt   time.Time   // when to try again after the last failure
+	lastErr   error
+}
+
+// obtainCall is a request for a certificate shared by every handshake waiting on it.
+type obtainCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// TLSConfig returns a tls.Config that serves the managed certificate.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate. The first calls block while the key is
+// loaded and the certificate is obtained.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx := context.Background()
+	if hello != nil && hello.Context() != nil {
+		ctx = hello.Context()
+	}
+	return m.Certificate(ctx)
+}
+
+// Certificate returns the current certificate, loading it from the cache or obtaining a new one
+// as needed. Concurrent callers share one request to the server. After a failed request, callers
+// get the same error until a backoff of up to an hour has passed.
+func (m *Manager) Certificate(ctx context.Context) (*tls.Certificate, error) {
+	m.mu.Lock()
+	if m.cert != nil {
+		defer m.mu.Unlock()
+		return m.cert, nil
+	}
+
+	call := m.obtaining
+	if call == nil {
+		var err error
+		call, err = m.startObtain(ctx)
+		if call == nil || err != nil {
+			defer m.mu.Unlock()
+			return m.cert, err
+		}
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+		return call.cert, call.err
+	}
+}
+
+// startObtain loads the key and cached certificate, and starts requesting a new certificate if
+// the cached one won't do. It returns a nil call if m.cert was set from the cache. m.mu must be
+// held.
+func (m *Manager) startObtain(ctx context.Context) (*obtainCall, error) {
+	err := m.loadKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// use the cached certificate if it is still good
+	cached, err := m.loadCachedCert(ctx)
+	if err != nil {
+		log.Printf("tlspage: ignoring cached certificate: %v", err)
+	}
+	if cached != nil && time.Until(cached.Leaf.NotAfter) > m.renewBefore() {
+		m.setCert(cached)
+		return nil, nil
+	}
+
+	if m.lastErr != nil && time.Now().Before(m.retryAt) {
+		if m.useCached(cached, m.lastErr) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("not retrying until %s: %v", m.retryAt.Format(time.RFC3339), m.lastErr)
+	}
+
+	// make sure lazily initialized fields are set before we let go of the lock
+	m.cache()
+	m.client()
+
+	call := &obtainCall{done: make(chan struct{})}
+	m.obtaining = call
+	go m.runObtain(call, cached)
+	return call, nil
+}
+
+// runObtain requests a certificate for call. It isn't tied to the context of any one handshake,
+// since others may be waiting on it too.
+func (m *Manager) runObtain(call *obtainCall, cached *tls.Certificate) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	cert, err := m.obtain(ctx)
+
+	m.mu.Lock()
+	defer close(call.done)
+	defer m.mu.Unlock()
+
+	m.obtaining = nil
+	if err != nil {
+		m.failures++
+		m.retryAt = time.Now().Add(min(time.Minute<<min(m.failures-1, 6), time.Hour))
+		m.lastErr = err
+		if m.useCached(cached, err) {
+			call.cert = m.cert
+			return
+		}
+		call.err = err
+		return
+	}
+	m.failures = 0
+	m.lastErr = nil
+	m.setCert(cert)
+	call.cert = m.cert
+}
+
+// useCached makes an old cached certificate current after a failure to replace it, if it hasn't
+// expired yet. An old certificate is better than none at all. m.mu must be held.
+func (m *Manager) useCached(cached *tls.Certificate, err error) bool {
+	if cached == nil || !time.Now().Before(cached.Leaf.NotAfter) {
+		return false
+	}
+	log.Printf("tlspage: using cached certificate, renewal failed: %v", err)
+	m.cert = cached
+	m.scheduleRenewal(time.Hour)
+	return true
+}
+
+// Hostname returns the key-pinned base name for the managed key (ex: "xxx.xxx.tls.page"),
+// generating the key if needed. It does not obtain a certificate.
+func (m *Manager) Hostname(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.loadKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return m.hostname, nil
+}
+
+// Close stops background renewal.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	if m.renewTimer != nil {
+		m.renewTimer.Stop()
+		m.renewTimer = nil
+	}
+	return nil
+}
+
+func (m *Manager) cache() Cache {
+	if m.Cache == nil {
+		m.Cache = NewMemCache()
+	}
+	return m.Cache
+}
+
+func (m *Manager) origin() string {
+	if m.Origin == "" {
+		return "tls.page"
+	}
+	return m.Origin
+}
+
+func (m *Manager) client() *Client {
+	if m.Client == nil {
+		m.Client = NewClient(m.origin())
+	}
+	return m.Client
+}
+
+func (m *Manager) renewBefore() time.Duration {
+	if m.RenewBefore == 0 {
+		return 30 * 24 * time.Hour
+	}
+	return m.RenewBefore
+}
+
+// loadKey loads the private key from the cache, or generates and stores a new one.
+// m.mu must be held.
+func (m *Manager) loadKey(ctx context.Context) error {
+	if m.privKeyPEM != "" {
+		return nil
+	}
+
+	data, err := m.cache().Get(ctx, managerKeyName)
+	if errors.Is(err, ErrCacheMiss) {
+		keyType := m.KeyType
+		if keyType == "" {
+			keyType = KeyTypeECDSAP256
+		}
+		privKeyPEM, err := GenerateKeyWithType(keyType)
+		if err != nil {
+			return err
+		}
+		err = m.cache().Put(ctx, managerKeyName, []byte(privKeyPEM))
+		if err != nil {
+			return fmt.Errorf("failed to save private key: %v", err)
+		}
+		data = []byte(privKeyPEM)
+	} else if err != nil {
+		return fmt.Errorf("failed to load private key: %v", err)
+	}
+
+	// tls.X509KeyPair doesn't understand every format we accept, so keep the key as PKCS#8
+	privKey, err := ParsePrivateKey(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse private key: %v", err)
+	}
+	privKeyPEM, err := marshalPrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+	hostname, err := HostnameFromPublicKey(privKey.Public(), m.origin())
+	if err != nil {
+		return err
+	}
+	m.privKeyPEM = privKeyPEM
+	m.hostname = hostname
+	return nil
+}
+
+// loadCachedCert returns the cached certificate if there is one for the current key.
+// m.mu must be held.
+func (m *Manager) loadCachedCert(ctx context.Context) (*tls.Certificate, error) {
+	chain, err := m.cache().Get(ctx, managerCertName)
+	if errors.Is(err, ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.keyPair(chain)
+}
+
+// obtain requests a new certificate and stores it in the cache. The key must already be loaded.
+func (m *Manager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	csrPEM, err := GenerateCSR(m.privKeyPEM, m.hostname)
+	if err != nil {
+		return nil, err
+	}
+	certPEMs, err := m.client().CertFromCSR(ctx, csrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate: %v", err)
+	}
+
+	var chain []byte
+	for _, certPEM := range certPEMs {
+		chain = append(chain, certPEM...)
+	}
+	cert, err := m.keyPair(chain)
+	if err != nil {
+		return nil, err
+	}
+	err = m.cache().Put(ctx, managerCertName, chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// keyPair combines a PEM certificate chain with the current key and checks that the
+// leaf is for the current hostname.
+func (m *Manager) keyPair(chain []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(chain, []byte(m.privKeyPEM))
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := ParseHostname(m.hostname, m.origin())
+	if err != nil {
+		return nil, err
+	}
+	err = pinned.VerifyCertificate(cert.Leaf)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// setCert makes cert current and schedules its renewal. m.mu must be held.
+func (m *Manager) setCert(cert *tls.Certificate) {
+	m.cert = cert
+
+	// short-lived certificates are renewed after a third of their remaining lifetime instead
+	d := time.Until(cert.Leaf.NotAfter) - m.renewBefore()
+	if d <= 0 {
+		d = time.Until(cert.Leaf.NotAfter) / 3
+	}
+	m.scheduleRenewal(d)
+}
+
+// scheduleRenewal arranges for renew to run after d. m.mu must be held.
+func (m *Manager) scheduleRenewal(d time.Duration) {
+	if m.closed {
+		return
+	}
+	if m.renewTimer != nil {
+		m.renewTimer.Stop()
+	}
+	m.renewTimer = time.AfterFunc(max(d, time.Minute), m.renew)
+}
+
+// renew runs in the background to replace the certificate before it expires.
+func (m *Manager) renew() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	// make sure lazily initialized fields are set before we let go of the lock
+	m.cache()
+	m.client()
+	m.mu.Unlock()
+
+	// don't hold the lock while talking to the server, handshakes still need the old cert
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	cert, err := m.obtain(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		log.Printf("tlspage: failed to renew certificate for %s: %v", m.hostname, err)
+		m.scheduleRenewal(time.Hour)
+		return
+	}
+	m.setCert(cert)
+}
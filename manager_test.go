@@ -0,0 +1,97 @@
+package tlspage_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9072997/tlspage"
+	"github.com/9072997/tlspage/tlspagetest"
+)
+
+func TestManagerConcurrentCertificate(t *testing.T) {
+	srv := tlspagetest.NewServer("")
+	defer srv.Close()
+	srv.SetDelay(200 * time.Millisecond)
+
+	m := &tlspage.Manager{Client: srv.Client()}
+	defer m.Close()
+
+	// a handshake that gives up doesn't cancel the request for everyone else
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := m.Certificate(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Certificate() with a short deadline error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the lock isn't held while the certificate is requested
+	start := time.Now()
+	_, err = m.Hostname(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Hostname() took %v while a certificate was being requested", d)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var leaves []string
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert, err := m.Certificate(context.Background())
+			if err != nil {
+				t.Errorf("Certificate() error = %v", err)
+				return
+			}
+			mu.Lock()
+			leaves = append(leaves, string(cert.Leaf.Raw))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if srv.Requests() != 1 {
+		t.Errorf("concurrent Certificate() calls made %d requests, want 1", srv.Requests())
+	}
+	for _, leaf := range leaves {
+		if leaf != leaves[0] {
+			t.Errorf("concurrent Certificate() calls returned different certificates")
+			break
+		}
+	}
+}
+
+func TestManagerBackoff(t *testing.T) {
+	srv := tlspagetest.NewServer("")
+	defer srv.Close()
+	srv.FailNext(1, http.StatusBadRequest)
+
+	m := &tlspage.Manager{Client: srv.Client()}
+	defer m.Close()
+
+	_, err := m.Certificate(context.Background())
+	if err == nil {
+		t.Fatal("Certificate() error = nil, want the injected failure")
+	}
+	if srv.Requests() != 1 {
+		t.Fatalf("Certificate() made %d requests, want 1", srv.Requests())
+	}
+
+	// the next handshakes fail straight away instead of asking the server again
+	for range 3 {
+		_, err = m.Certificate(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "not retrying until") {
+			t.Errorf("Certificate() after a failure error = %v, want a backoff error", err)
+		}
+	}
+	if srv.Requests() != 1 {
+		t.Errorf("Certificate() during the backoff made %d requests, want 1", srv.Requests())
+	}
+}
@@ -0,0 +1,135 @@
+package tlspage_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/9072997/tlspage"
+	"github.com/9072997/tlspage/tlspagetest"
+)
+
+// servePinned starts an HTTPS server on 127.0.0.1 with a certificate from srv and returns its URL
+// and leaf certificate.
+func servePinned(t *testing.T, srv *tlspagetest.Server) (string, *x509.Certificate) {
+	t.Helper()
+	m := &tlspage.Manager{Client: srv.Client(), Origin: srv.Origin}
+	t.Cleanup(func() { m.Close() })
+	ln, urls, err := tlspage.Listen("127.0.0.1:0", &tlspage.ListenOptions{Manager: m})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	hs := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("ok"))
+	})}
+	go hs.Serve(ln)
+	t.Cleanup(func() { hs.Close() })
+
+	cert, err := m.Certificate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return urls[0], cert.Leaf
+}
+
+func TestVerifyPinnedConnection(t *testing.T) {
+	srv := tlspagetest.NewServer("")
+	defer srv.Close()
+	goodURL, leaf := servePinned(t, srv)
+	otherURL, _ := servePinned(t, srv)
+
+	hostnameOf := func(rawURL string) string {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Hostname()
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		certs      []*x509.Certificate
+		wantErr    bool
+	}{
+		{"good pin", hostnameOf(goodURL), []*x509.Certificate{leaf}, false},
+		{"wrong key", hostnameOf(otherURL), []*x509.Certificate{leaf}, true},
+		{"wrong hostname", "example.com", []*x509.Certificate{leaf}, true},
+		{"other origin", hostnameOf(goodURL) + ".example.com", []*x509.Certificate{leaf}, true},
+		{"no certificate", hostnameOf(goodURL), nil, true},
+	}
+	verify := tlspage.VerifyPinnedConnection(srv.Origin)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verify(tls.ConnectionState{ServerName: tt.serverName, PeerCertificates: tt.certs})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyPinnedConnection() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewPinnedTransport(t *testing.T) {
+	srv := tlspagetest.NewServer("")
+	defer srv.Close()
+	goodURL, _ := servePinned(t, srv)
+	otherURL, _ := servePinned(t, srv)
+
+	good, err := url.Parse(goodURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := url.Parse(otherURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, base, err := tlspage.IPFromHostname(good.Hostname())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the web PKI check needs the fake server's roots
+	webPKI := tlspage.NewPinnedTransport(srv.Origin, false)
+	webPKI.TLSClientConfig.RootCAs = srv.Roots
+
+	tests := []struct {
+		name      string
+		transport *http.Transport
+		url       string
+		wantErr   bool
+	}{
+		{"good pin", tlspage.NewPinnedTransport(srv.Origin, true), goodURL, false},
+		{"good pin and chain", webPKI, goodURL, false},
+		{"untrusted chain", tlspage.NewPinnedTransport(srv.Origin, false), goodURL, true},
+		// other's key is pinned in the name, but good's server answers
+		{"wrong key", tlspage.NewPinnedTransport(srv.Origin, true), "https://" + net.JoinHostPort(other.Hostname(), good.Port()), true},
+		{"no IP label", tlspage.NewPinnedTransport(srv.Origin, true), "https://" + net.JoinHostPort(base, good.Port()), true},
+		{"wrong hostname", tlspage.NewPinnedTransport(srv.Origin, true), "https://" + net.JoinHostPort("127-0-0-1.example.com", good.Port()), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.transport.CloseIdleConnections()
+			client := &http.Client{Transport: tt.transport}
+			resp, err := client.Get(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GET %s error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "ok" {
+				t.Errorf("GET %s = %q, want %q", tt.url, body, "ok")
+			}
+		})
+	}
+}
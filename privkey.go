@@ -0,0 +1,353 @@
+package tlspage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// iteration count used by EncryptPrivateKey (OWASP recommendation for PBKDF2-HMAC-SHA256)
+const pbkdf2Iterations = 600000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// RFC 5208 EncryptedPrivateKeyInfo
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// RFC 8018 PBES2-params
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// RFC 8018 PBKDF2-params, without support for the "otherSource" salt choice
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// ParsePrivateKey parses a PEM-encoded private key of any supported key type. PKCS#8
+// ("PRIVATE KEY"), SEC1 ("EC PRIVATE KEY"), PKCS#1 ("RSA PRIVATE KEY") and unencrypted OpenSSH
+// ("OPENSSH PRIVATE KEY") blocks are accepted. Encrypted keys must go through DecryptPrivateKey.
+func ParsePrivateKey(privKeyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(privKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM private key")
+	}
+
+	var privKey any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		privKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privKey, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		privKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		privKey, err = ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("private key is encrypted")
+		}
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("private key is encrypted")
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	// x/crypto/ssh returns Ed25519 keys by pointer
+	if edKey, ok := privKey.(*ed25519.PrivateKey); ok {
+		privKey = *edKey
+	}
+
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T cannot sign", privKey)
+	}
+	_, err = KeyTypeOf(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// marshalPrivateKey returns privKey as a PEM-encoded PKCS#8 string.
+func marshalPrivateKey(privKey crypto.Signer) (string, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal private key: %v", err)
+	}
+
+	keyBlock := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: pkcs8,
+	}
+	return string(pem.EncodeToMemory(keyBlock)), nil
+}
+
+// IsEncryptedPrivateKey reports whether the first PEM block in privKeyPEM is a
+// passphrase-protected private key that must be passed to DecryptPrivateKey before use.
+func IsEncryptedPrivateKey(privKeyPEM string) bool {
+	block, _ := pem.Decode([]byte(privKeyPEM))
+	if block == nil {
+		return false
+	}
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		return true
+	case "OPENSSH PRIVATE KEY":
+		_, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+		var missing *ssh.PassphraseMissingError
+		return errors.As(err, &missing)
+	}
+	return false
+}
+
+// DecryptPrivateKey decrypts a passphrase-protected private key and returns it as an unencrypted
+// PEM-encoded PKCS#8 string. It accepts PKCS#8 "ENCRYPTED PRIVATE KEY" blocks using PBES2 with
+// PBKDF2 and AES-CBC (what OpenSSL and EncryptPrivateKey produce), and encrypted OpenSSH keys.
+// Unencrypted keys in any supported format are converted to PKCS#8 and the passphrase is ignored.
+func DecryptPrivateKey(privKeyPEM string, passphrase []byte) (string, error) {
+	block, _ := pem.Decode([]byte(privKeyPEM))
+	if block == nil {
+		return "", fmt.Errorf("failed to decode PEM private key")
+	}
+
+	var privKey crypto.Signer
+	var err error
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		var der []byte
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return "", err
+		}
+		privKey, err = ParsePrivateKey(string(pem.EncodeToMemory(&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: der,
+		})))
+	case IsEncryptedPrivateKey(privKeyPEM):
+		var raw any
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(pem.EncodeToMemory(block), passphrase)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt private key: %v", err)
+		}
+		if edKey, ok := raw.(*ed25519.PrivateKey); ok {
+			raw = *edKey
+		}
+		var ok bool
+		privKey, ok = raw.(crypto.Signer)
+		if !ok {
+			return "", fmt.Errorf("private key of type %T cannot sign", raw)
+		}
+		_, err = KeyTypeOf(privKey.Public())
+	default:
+		privKey, err = ParsePrivateKey(privKeyPEM)
+	}
+	if err != nil {
+		return "", err
+	}
+	return marshalPrivateKey(privKey)
+}
+
+// EncryptPrivateKey encrypts a private key in any supported format with passphrase and returns
+// it as a PEM-encoded "ENCRYPTED PRIVATE KEY". It uses PBES2 with PBKDF2-HMAC-SHA256 and
+// AES-256-CBC, which OpenSSL and most TLS servers can read.
+func EncryptPrivateKey(privKeyPEM string, passphrase []byte) (string, error) {
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("passphrase is empty")
+	}
+	privKey, err := ParsePrivateKey(privKeyPEM)
+	if err != nil {
+		return "", err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal private key: %v", err)
+	}
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	_, err = rand.Read(iv)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return "", err
+	}
+	aesCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	padLen := aes.BlockSize - len(pkcs8)%aes.BlockSize
+	encrypted := append(pkcs8, bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	cipher.NewCBCEncrypter(aesCipher, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF: pkix.AlgorithmIdentifier{
+			Algorithm:  oidHMACWithSHA256,
+			Parameters: asn1.NullRawValue,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return "", err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBKDF2,
+			Parameters: asn1.RawValue{FullBytes: kdfParams},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: ivParam},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBES2,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	keyBlock := &pem.Block{
+		Type:  "ENCRYPTED PRIVATE KEY",
+		Bytes: der,
+	}
+	return string(pem.EncodeToMemory(keyBlock)), nil
+}
+
+// decryptPKCS8 decrypts a DER EncryptedPrivateKeyInfo and returns the DER PKCS#8 key inside.
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted private key: %v", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption algorithm %v (only PBES2 is supported)", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PBES2 parameters: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %v (only PBKDF2 is supported)", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PBKDF2 parameters: %v", err)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdfParams.PRF.Algorithm == nil, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 PRF %v", kdfParams.PRF.Algorithm)
+	}
+
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported key encryption cipher %v (only AES-CBC is supported)", params.EncryptionScheme.Algorithm)
+	}
+	if kdfParams.KeyLength != 0 && kdfParams.KeyLength != keyLen {
+		return nil, fmt.Errorf("PBKDF2 key length %d does not match cipher", kdfParams.KeyLength)
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid AES-CBC IV")
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdfParams.Salt, kdfParams.IterationCount, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	aesCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted private key has invalid length")
+	}
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(aesCipher, iv).CryptBlocks(decrypted, data)
+
+	// a wrong passphrase almost always shows up as bad padding
+	padLen := int(decrypted[len(decrypted)-1])
+	if padLen == 0 || padLen > aes.BlockSize ||
+		!bytes.Equal(decrypted[len(decrypted)-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, fmt.Errorf("failed to decrypt private key: incorrect passphrase")
+	}
+	return decrypted[:len(decrypted)-padLen], nil
+}
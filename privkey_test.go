@@ -0,0 +1,155 @@
+package tlspage
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPrivateKeyFormats(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeECDSAP256, KeyTypeRSA2048, KeyTypeEd25519} {
+		t.Run(string(keyType), func(t *testing.T) {
+			privKeyPEM, err := GenerateKeyWithType(keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := Hostname(privKeyPEM, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			privKey, err := ParsePrivateKey(privKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			passphrase := []byte("correct horse battery staple")
+
+			formats := map[string]string{}
+			switch k := privKey.(type) {
+			case *ecdsa.PrivateKey:
+				der, err := x509.MarshalECPrivateKey(k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				formats["sec1"] = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+			case *rsa.PrivateKey:
+				der := x509.MarshalPKCS1PrivateKey(k)
+				formats["pkcs1"] = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}))
+			}
+			block, err := ssh.MarshalPrivateKey(privKey, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			formats["openssh"] = string(pem.EncodeToMemory(block))
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(privKey, "", passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			formats["openssh-encrypted"] = string(pem.EncodeToMemory(block))
+			formats["pkcs8-encrypted"], err = EncryptPrivateKey(privKeyPEM, passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, keyPEM := range formats {
+				encrypted := IsEncryptedPrivateKey(keyPEM)
+				if encrypted {
+					_, err := Hostname(keyPEM, "example.com")
+					if err == nil {
+						t.Errorf("%s: Hostname() accepted an encrypted key", name)
+					}
+					_, err = DecryptPrivateKey(keyPEM, []byte("wrong"))
+					if err == nil {
+						t.Errorf("%s: DecryptPrivateKey() accepted the wrong passphrase", name)
+					}
+				}
+
+				decrypted, err := DecryptPrivateKey(keyPEM, passphrase)
+				if err != nil {
+					t.Errorf("%s: DecryptPrivateKey() error = %v", name, err)
+					continue
+				}
+				got, err := Hostname(decrypted, "example.com")
+				if err != nil || got != want {
+					t.Errorf("%s: Hostname() = %v, %v, want %v", name, got, err, want)
+				}
+				if !encrypted {
+					got, err = Hostname(keyPEM, "example.com")
+					if err != nil || got != want {
+						t.Errorf("%s: Hostname() = %v, %v, want %v", name, got, err, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// The testdata keys were made with
+//
+//	openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -out pbes2-key.pem
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -in pbes2-key.pem -passout pass:tlspage-test
+//
+// with "-v2prf hmacWithSHA1" and "-v2 aes-128-cbc" for the other variants.
+const opensslPassphrase = "tlspage-test"
+
+func TestDecryptOpenSSLPrivateKey(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "pbes2-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"pbes2-aes256-sha256.pem", "pbes2-aes256-sha1.pem", "pbes2-aes128-sha256.pem"} {
+		t.Run(name, func(t *testing.T) {
+			encrypted, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsEncryptedPrivateKey(string(encrypted)) {
+				t.Errorf("IsEncryptedPrivateKey() = false")
+			}
+			got, err := DecryptPrivateKey(string(encrypted), []byte(opensslPassphrase))
+			if err != nil {
+				t.Fatalf("DecryptPrivateKey() error = %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("DecryptPrivateKey() = %s, want %s", got, want)
+			}
+			_, err = DecryptPrivateKey(string(encrypted), []byte("wrong"))
+			if err == nil {
+				t.Errorf("DecryptPrivateKey() accepted the wrong passphrase")
+			}
+		})
+	}
+}
+
+func TestEncryptPrivateKeyOpenSSL(t *testing.T) {
+	opensslPath, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "pbes2-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := EncryptPrivateKey(string(want), []byte(opensslPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(opensslPath, "pkcs8", "-passin", "pass:"+opensslPassphrase)
+	cmd.Stdin = strings.NewReader(encrypted)
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("openssl pkcs8 could not decrypt EncryptPrivateKey() output: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("openssl pkcs8 decrypted %s, want %s", got, want)
+	}
+}
@@ -10,18 +10,27 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"log"
 	"os"
 	"strings"
 	"time"
 
 	"golang.org/x/crypto/acme"
+	"golang.org/x/sync/singleflight"
 )
 
+// issuance, including waiting for another server's order for the same name, is given up after
+// this long
+const issuanceTimeout = 10 * time.Minute
+
 type ACME struct {
 	client  *acme.Client
 	account *acme.Account
 	cache   *CertCache
 	MinLife time.Duration
+
+	leases   *IssuanceLeases
+	inflight *singleflight.Group // keyed by base name
 }
 
 // NewACME creates a new ACME instance, registering or loading an account from the given file.
@@ -114,43 +123,171 @@ func NewACME(accountFile, eabFile, directoryURL string, cacheDB *sql.DB) (ACME,
 	if err != nil {
 		return ACME{}, fmt.Errorf("failed to create certificate cache: %v", err)
 	}
+	leases, err := NewIssuanceLeases(cacheDB)
+	if err != nil {
+		return ACME{}, fmt.Errorf("failed to create issuance leases: %v", err)
+	}
 
 	return ACME{
 		client:  client,
 		account: account,
 		cache:   cache,
 		MinLife: 60 * 24 * time.Hour,
+
+		leases:   leases,
+		inflight: &singleflight.Group{},
 	}, nil
 }
 
-// just a wrapper for the requestCert function that retries the request if it fails
-func (a *ACME) RequestCert(ctx context.Context, baseName string, csrData []byte, backend DNSBackend) ([]byte, error) {
+// issued is the result of an issuance shared by concurrent requests for a name.
+type issued struct {
+	cert      []byte
+	fromCache bool
+}
+
+// RequestCert returns a certificate for baseName, from the cache or by running an ACME order
+// with csrData. Concurrent requests for the same name, in this process or anywhere in the
+// cluster, share one order. fromCache is true if the certificate was already in the cache rather
+// than newly issued.
+func (a *ACME) RequestCert(ctx context.Context, baseName string, csrData []byte, backend DNSBackend) (cert []byte, fromCache bool, err error) {
+	ch := a.inflight.DoChan(baseName, func() (any, error) {
+		// other requests may be waiting on this order, so it must not be cancelled if the
+		// request that started it goes away
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), issuanceTimeout)
+		defer cancel()
+
+		cert, fromCache, err := a.requestCertLeased(ctx, baseName, csrData, backend)
+		return issued{cert, fromCache}, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, false, res.Err
+		}
+		r := res.Val.(issued)
+		return r.cert, r.fromCache, nil
+	}
+}
+
+// requestCertLeased takes the cluster-wide issuance lease for baseName, waiting for any other
+// server holding it, and then requests the certificate. If the other server's order fills the
+// cache while we wait, that certificate is returned instead, and if it fails, so do we.
+func (a *ACME) requestCertLeased(ctx context.Context, baseName string, csrData []byte, backend DNSBackend) ([]byte, bool, error) {
+	subject := "*." + baseName
+	var waitStart time.Time
+	for {
+		_, cachedCert, expiry, err := a.cache.Get(subject)
+		if err != nil {
+			return nil, false, fmt.Errorf("certificate cache error: %v", err)
+		}
+		if time.Until(expiry) > a.MinLife {
+			return cachedCert, true, nil
+		}
+
+		if !waitStart.IsZero() {
+			failure, err := a.leases.Failure(subject, waitStart)
+			if err != nil {
+				return nil, false, err
+			}
+			if failure != nil {
+				return nil, false, failure
+			}
+		}
+
+		acquired, err := a.leases.Acquire(subject)
+		if err != nil {
+			return nil, false, err
+		}
+		if acquired {
+			break
+		}
+		if waitStart.IsZero() {
+			log.Printf("Waiting for another server to finish issuing %s", subject)
+			waitStart = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(issuanceLeaseWait):
+		}
+	}
+	defer func() {
+		err := a.leases.Release(subject)
+		if err != nil {
+			log.Printf("Failed to release issuance lease for %s: %v", subject, err)
+		}
+	}()
+
+	// keep the lease for as long as the order runs. Without it another server could start an
+	// order for the same name, so the order is cancelled if the lease can't be renewed.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		ticker := time.NewTicker(issuanceLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := a.leases.Renew(subject)
+				if err != nil {
+					log.Printf("Failed to renew issuance lease for %s: %v", subject, err)
+					cancel(fmt.Errorf("failed to renew issuance lease: %v", err))
+					return
+				}
+			}
+		}
+	}()
+
+	cert, fromCache, err := a.requestCertWithRetries(ctx, baseName, csrData, backend)
+	// an order that was cancelled or timed out says nothing about whether the name can be issued
+	if err != nil && ctx.Err() == nil {
+		recordErr := a.leases.RecordFailure(subject, err)
+		if recordErr != nil {
+			log.Printf("Failed to record issuance failure for %s: %v", subject, recordErr)
+		}
+	}
+	return cert, fromCache, err
+}
+
+// just a wrapper for the requestCert function that retries the request if it fails.
+func (a *ACME) requestCertWithRetries(ctx context.Context, baseName string, csrData []byte, backend DNSBackend) (cert []byte, fromCache bool, err error) {
 	delay := ACMERetryDelay
-	var err error
 	for i := range ACMERetries {
-		var cert []byte
-		cert, err = a.requestCert(ctx, baseName, csrData, backend)
+		cert, fromCache, err = a.requestCert(ctx, baseName, csrData, backend)
 		if err == nil {
-			return cert, nil
+			return cert, fromCache, nil
+		}
+		// retrying would only use up more of the limit
+		if errorCode(err) == "acme_rate_limited" {
+			break
 		}
 		if i < ACMERetries-1 {
-			time.Sleep(delay)
+			select {
+			case <-ctx.Done():
+				return nil, false, context.Cause(ctx)
+			case <-time.After(delay):
+			}
 			delay *= 2
 		}
 	}
-	return nil, err
+	return nil, false, err
 }
 
 // RequestCert requests a certificate using the provided CSR, DNSBackend, and context.
-func (a *ACME) requestCert(ctx context.Context, baseName string, csrData []byte, backend DNSBackend) ([]byte, error) {
+func (a *ACME) requestCert(ctx context.Context, baseName string, csrData []byte, backend DNSBackend) ([]byte, bool, error) {
 	// first, check if we have an eligible certificate in the cache
 	_, cachedCert, expiry, err := a.cache.Get("*." + baseName)
 	if err != nil {
-		return nil, fmt.Errorf("certificate cache error: %v", err)
+		return nil, false, fmt.Errorf("certificate cache error: %v", err)
 	}
 	if time.Until(expiry) > a.MinLife {
 		// we have a valid certificate in the cache, return it
-		return cachedCert, nil
+		return cachedCert, true, nil
 	}
 
 	// Start the certificate order
@@ -164,14 +301,14 @@ func (a *ACME) requestCert(ctx context.Context, baseName string, csrData []byte,
 		},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to start certificate order: %v", err)
+		return nil, false, acmeFailure("failed to start certificate order", err)
 	}
 
 	// Complete the DNS-01 challenge
 	for _, authz := range order.AuthzURLs {
 		auth, err := a.client.GetAuthorization(ctx, authz)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get authorization: %v", err)
+			return nil, false, acmeFailure("failed to get authorization", err)
 		}
 
 		var challenge *acme.Challenge
@@ -182,13 +319,13 @@ func (a *ACME) requestCert(ctx context.Context, baseName string, csrData []byte,
 			}
 		}
 		if challenge == nil {
-			return nil, fmt.Errorf("no DNS-01 challenge found")
+			return nil, false, &codedError{"acme_error", fmt.Errorf("no DNS-01 challenge found")}
 		}
 
 		// Get the DNS-01 challenge key
 		key, err := a.client.DNS01ChallengeRecord(challenge.Token)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get DNS-01 challenge key: %v", err)
+			return nil, false, fmt.Errorf("failed to get DNS-01 challenge key: %v", err)
 		}
 
 		// Add the TXT record to the DNS backend
@@ -200,27 +337,27 @@ func (a *ACME) requestCert(ctx context.Context, baseName string, csrData []byte,
 		// Wait for DNS propagation
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, false, ctx.Err()
 		case <-time.After(10 * time.Second):
 		}
 
 		// Complete the challenge
 		_, err = a.client.Accept(ctx, challenge)
 		if err != nil {
-			return nil, fmt.Errorf("failed to accept challenge: %v", err)
+			return nil, false, acmeFailure("failed to accept challenge", err)
 		}
 
 		// Wait for the authorization to be valid
 		_, err = a.client.WaitAuthorization(ctx, authz)
 		if err != nil {
-			return nil, fmt.Errorf("authorization failed: %v", err)
+			return nil, false, acmeFailure("authorization failed", err)
 		}
 	}
 
 	// Finalize the order with the CSR
 	certs, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csrData, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to finalize order: %v", err)
+		return nil, false, acmeFailure("failed to finalize order", err)
 	}
 
 	// PEM encode the certificate
@@ -236,10 +373,20 @@ func (a *ACME) requestCert(ctx context.Context, baseName string, csrData []byte,
 	// Save the certificate to the cache
 	err = a.cache.Put(csrData, encoded)
 	if err != nil {
-		return nil, fmt.Errorf("failed to save certificate to cache: %v", err)
+		return nil, false, fmt.Errorf("failed to save certificate to cache: %v", err)
 	}
 
-	return encoded, nil
+	return encoded, false, nil
+}
+
+// acmeFailure describes an error from the ACME server, coded acme_rate_limited if the CA is
+// rate limiting us and acme_error otherwise.
+func acmeFailure(msg string, err error) error {
+	code := "acme_error"
+	if _, ok := acme.RateLimit(err); ok {
+		code = "acme_rate_limited"
+	}
+	return &codedError{code, fmt.Errorf("%s: %v", msg, err)}
 }
 
 func parseEABFile(eabFile string) (*acme.ExternalAccountBinding, error) {
@@ -7,8 +7,6 @@ import (
 	"encoding/pem"
 	"fmt"
 	"time"
-
-	"github.com/9072997/tlspage"
 )
 
 type CertCache struct {
@@ -113,14 +111,9 @@ func (c *CertCache) PutCSR(csr []byte, origin string) error {
 }
 
 func (c *CertCache) PutKey(key, origin string) error {
-	hostname, err := tlspage.Hostname(key, origin)
+	_, csr, err := KeyPinnedCSR(key, origin)
 	if err != nil {
-		return fmt.Errorf("failed to get hostname from key: %v", err)
-	}
-
-	csr, err := tlspage.GenerateCSR(key, hostname)
-	if err != nil {
-		return fmt.Errorf("failed to generate CSR: %v", err)
+		return err
 	}
-	return c.PutCSR([]byte(csr), origin)
+	return c.PutCSR(csr, origin)
 }
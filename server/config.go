@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/9072997/tlspage"
 	"github.com/BurntSushi/toml"
 )
 
@@ -17,6 +19,7 @@ var (
 	ACMERetries        = 3
 	ACMERetryDelay     = 15 * time.Second
 	CAAIdentifier      = "letsencrypt.org"
+	AllowedKeyTypes    = []string{"ecdsa-p256", "ecdsa-p384", "rsa-2048", "rsa-3072", "rsa-4096"}
 )
 
 type Config struct {
@@ -29,24 +32,27 @@ type Config struct {
 	ACMERetries        int           `toml:"acme_retries"`
 	ACMERetryDelay     time.Duration `toml:"acme_retry_delay"`
 	CAAIdentifier      string        `toml:"caa_identifier"`
+	AllowedKeyTypes    []string      `toml:"allowed_key_types"`
 }
 
 func LoadOrInitConfig(path string) error {
+	defaultCfg := Config{
+		Origin:             Origin,
+		PackageNameVersion: PackageNameVersion,
+		DqliteTimeout:      DqliteTimeout,
+		ShutdownTimeout:    ShutdownTimeout,
+		ACMEDirectoryURL:   ACMEDirectoryURL,
+		ACMETimeout:        ACMETimeout,
+		ACMERetries:        ACMERetries,
+		ACMERetryDelay:     ACMERetryDelay,
+		CAAIdentifier:      CAAIdentifier,
+		AllowedKeyTypes:    AllowedKeyTypes,
+	}
+
 	// Check if file exists
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		// Write default config
-		defaultCfg := Config{
-			Origin:             Origin,
-			PackageNameVersion: PackageNameVersion,
-			DqliteTimeout:      DqliteTimeout,
-			ShutdownTimeout:    ShutdownTimeout,
-			ACMEDirectoryURL:   ACMEDirectoryURL,
-			ACMETimeout:        ACMETimeout,
-			ACMERetries:        ACMERetries,
-			ACMERetryDelay:     ACMERetryDelay,
-			CAAIdentifier:      CAAIdentifier,
-		}
 		data, err := toml.Marshal(&defaultCfg)
 		if err != nil {
 			return err
@@ -63,7 +69,8 @@ func LoadOrInitConfig(path string) error {
 	}
 	defer f.Close()
 
-	var cfg Config
+	// settings missing from an older config file keep their defaults
+	cfg := defaultCfg
 	dec := toml.NewDecoder(f)
 	_, err = dec.Decode(&cfg)
 	if err != nil {
@@ -79,6 +86,13 @@ func LoadOrInitConfig(path string) error {
 	ACMERetries = cfg.ACMERetries
 	ACMERetryDelay = cfg.ACMERetryDelay
 	CAAIdentifier = cfg.CAAIdentifier
+	AllowedKeyTypes = cfg.AllowedKeyTypes
+	for _, t := range AllowedKeyTypes {
+		_, err := tlspage.ParseKeyType(t)
+		if err != nil {
+			return fmt.Errorf("invalid allowed_key_types: %v", err)
+		}
+	}
 
 	return nil
 }
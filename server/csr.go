@@ -1,67 +1,72 @@
 package main
 
 import (
-	"crypto/sha256"
+	"crypto"
 	"crypto/x509"
-	"encoding/hex"
+	"encoding/pem"
 	"fmt"
-)
-
-func getCSRNames(csr *x509.CertificateRequest) []string {
-	var names []string
-
-	// Add the Common Name (CN) if it exists
-	if len(csr.Subject.CommonName) > 0 {
-		names = append(names, csr.Subject.CommonName)
-	}
+	"slices"
 
-	// Add all Subject Alternative Names (SANs)
-	names = append(names, csr.DNSNames...)
-	names = append(names, csr.EmailAddresses...)
-	for _, ip := range csr.IPAddresses {
-		names = append(names, ip.String())
-	}
-	for _, uri := range csr.URIs {
-		names = append(names, uri.String())
-	}
-
-	return names
-}
+	"github.com/9072997/tlspage"
+)
 
 func CSRPinnedBaseName(csrData []byte, origin string) (subject string, err error) {
 	// Parse the CSR
 	csr, err := x509.ParseCertificateRequest(csrData)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse CSR: %v", err)
+		return "", &codedError{"invalid_csr", fmt.Errorf("failed to parse CSR: %v", err)}
 	}
 
-	// Get the public key bytes
-	pubKeyBytes, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	// Reject keys the CA will not issue for before we bother it
+	err = checkKeyType(csr.PublicKey)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal public key: %v", err)
+		return "", &codedError{"key_type_not_allowed", err}
 	}
 
-	// Calculate the SHA-256 hash
-	hash := sha256.Sum256(pubKeyBytes)
+	hostname, err := tlspage.HostnameFromCSR(csr, origin)
+	if err != nil {
+		return "", &codedError{"csr_name_mismatch", err}
+	}
+	return hostname, nil
+}
 
-	// Convert the hash to hex
-	fingerprint := hex.EncodeToString(hash[:])
+// checkKeyType returns an error if pub is not one of the AllowedKeyTypes.
+func checkKeyType(pub crypto.PublicKey) error {
+	keyType, err := tlspage.KeyTypeOf(pub)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(AllowedKeyTypes, string(keyType)) {
+		return fmt.Errorf(
+			"key type %s is not accepted by the configured CA (allowed: %v)",
+			keyType,
+			AllowedKeyTypes,
+		)
+	}
+	return nil
+}
 
-	// calculate expected key-pinned hostname
-	// DNS labels are limited to 63 characters, so use 2x32 labels
-	baseName := fingerprint[:32] + "." + fingerprint[32:] + "." + origin
-	expected := "*." + baseName
+// KeyPinnedCSR generates a CSR for the given PEM private key and validates it
+// the same way a submitted CSR would be. It returns the base name and the DER
+// encoded CSR.
+func KeyPinnedCSR(keyPEM string, origin string) (baseName string, csr []byte, err error) {
+	hostname, err := tlspage.Hostname(keyPEM, origin)
+	if err != nil {
+		return "", nil, &codedError{"invalid_key", fmt.Errorf("failed to get hostname from key: %v", err)}
+	}
 
-	// check if the expected hostname matched the names in the CSR
-	names := getCSRNames(csr)
-	for _, name := range names {
-		if name != expected {
-			return "", fmt.Errorf("CSR does not match expected hostname: %s", name)
-		}
+	csrPEM, err := tlspage.GenerateCSR(keyPEM, hostname)
+	if err != nil {
+		return "", nil, &codedError{"invalid_key", fmt.Errorf("failed to generate CSR: %v", err)}
 	}
-	if len(names) == 0 {
-		return "", fmt.Errorf("CSR does not contain any names")
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		return "", nil, fmt.Errorf("failed to decode PEM CSR")
 	}
 
-	return baseName, nil
+	baseName, err = CSRPinnedBaseName(block.Bytes, origin)
+	if err != nil {
+		return "", nil, err
+	}
+	return baseName, block.Bytes, nil
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// bodyKind describes the object an endpoint expects in its request body.
+type bodyKind struct {
+	Name      string   // for error messages
+	PEMTypes  []string // accepted PEM block types; the first is used for DER input
+	MIMETypes []string // content types naming this kind of object, in PEM or DER
+	JSONField string   // field holding the object in a JSON body
+	MaxBytes  int64
+}
+
+var (
+	csrBody = bodyKind{
+		Name:      "CSR",
+		PEMTypes:  []string{"CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST"},
+		MIMETypes: []string{"application/pkcs10"},
+		JSONField: "csr",
+		MaxBytes:  10 * 1024, // a CSR should never be larger than 10KB
+	}
+	certBody = bodyKind{
+		Name:     "certificate",
+		PEMTypes: []string{"CERTIFICATE"},
+		MIMETypes: []string{
+			"application/pkix-cert",
+			"application/pem-certificate-chain",
+			"application/x-x509-ca-cert",
+			"application/x-x509-user-cert",
+		},
+		JSONField: "cert",
+		MaxBytes:  64 * 1024, // room for a whole chain
+	}
+	keyBody = bodyKind{
+		Name:      "private key",
+		PEMTypes:  []string{"PRIVATE KEY", "EC PRIVATE KEY", "RSA PRIVATE KEY", "OPENSSH PRIVATE KEY"},
+		MIMETypes: []string{"application/pkcs8"},
+		JSONField: "key",
+		MaxBytes:  16 * 1024, // an RSA-4096 key is about 3KB as PEM
+	}
+)
+
+// body encodings
+const (
+	encPEM = 1 << iota
+	encDER
+	encBase64
+	encJSON
+	encAny = encPEM | encDER | encBase64
+)
+
+// checkMethod returns true if req uses one of methods. Otherwise it responds with 405 and
+// returns false. OPTIONS requests (CORS preflight) are answered here with 204.
+func checkMethod(resp http.ResponseWriter, req *http.Request, methods ...string) bool {
+	if slices.Contains(methods, req.Method) {
+		return true
+	}
+
+	resp.Header().Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+	if req.Method == http.MethodOptions {
+		resp.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	errMsg := fmt.Sprintf("Method %s not allowed", req.Method)
+	http.Error(resp, errMsg, http.StatusMethodNotAllowed)
+	return false
+}
+
+// decodeBody reads the body with readBody for a v1 endpoint. On failure it responds with a
+// plain text error and returns false.
+func decodeBody(resp http.ResponseWriter, req *http.Request, kind bodyKind) (*pem.Block, bool) {
+	block, err := readBody(resp, req, kind)
+	if err != nil {
+		http.Error(resp, err.Error(), errorStatus(err))
+		return nil, false
+	}
+	return block, true
+}
+
+// readBody reads a request body of at most kind.MaxBytes and returns the object in it as a PEM
+// block, whatever encoding it was sent in. The Content-Type decides which encodings are
+// accepted:
+//
+//   - application/json: {"<kind.JSONField>": "<PEM or base64 DER>"}
+//   - application/x-pem-file: PEM
+//   - application/octet-stream: DER
+//   - text/plain: PEM or base64 DER
+//   - one of kind.MIMETypes: PEM or DER
+//   - none, or application/x-www-form-urlencoded (curl's default): PEM, DER or base64 DER
+//
+// Errors are codedErrors: unsupported_media_type, request_too_large or invalid_request.
+func readBody(resp http.ResponseWriter, req *http.Request, kind bodyKind) (*pem.Block, error) {
+	encodings, err := bodyEncodings(req.Header.Get("Content-Type"), kind)
+	if err != nil {
+		return nil, &codedError{"unsupported_media_type", err}
+	}
+
+	// checking ContentLength first saves reading a body we will reject anyway
+	tooLarge := &codedError{"request_too_large", fmt.Errorf("Request too large (the limit for a %s is %d bytes)", kind.Name, kind.MaxBytes)}
+	if req.ContentLength > kind.MaxBytes {
+		return nil, tooLarge
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, kind.MaxBytes))
+	req.Body.Close()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, tooLarge
+	}
+	if err != nil {
+		return nil, &codedError{"invalid_request", fmt.Errorf("Failed to read request body")}
+	}
+
+	if encodings == encJSON {
+		// other fields are left alone, so clients can send extra ones of any type
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(data, &fields)
+		if err != nil {
+			return nil, &codedError{"invalid_request", fmt.Errorf("Failed to parse JSON body: %v", err)}
+		}
+		raw, ok := fields[kind.JSONField]
+		if !ok {
+			return nil, &codedError{"invalid_request", fmt.Errorf("JSON body has no %q field", kind.JSONField)}
+		}
+		var value string
+		err = json.Unmarshal(raw, &value)
+		if err != nil {
+			return nil, &codedError{"invalid_request", fmt.Errorf("JSON field %q must be a string", kind.JSONField)}
+		}
+		data = []byte(value)
+		encodings = encPEM | encBase64
+	}
+
+	block, err := decodeObject(data, encodings, kind)
+	if err != nil {
+		return nil, &codedError{"invalid_request", err}
+	}
+	return block, nil
+}
+
+// bodyEncodings returns the encodings accepted with contentType, or an error if it is a type
+// that can't hold kind.
+func bodyEncodings(contentType string, kind bodyKind) (int, error) {
+	if contentType == "" {
+		return encAny, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Content-Type: %v", err)
+	}
+
+	switch {
+	case mediaType == "application/json":
+		return encJSON, nil
+	case mediaType == "application/x-pem-file":
+		return encPEM, nil
+	case mediaType == "application/octet-stream":
+		return encDER, nil
+	case mediaType == "text/plain":
+		return encPEM | encBase64, nil
+	case slices.Contains(kind.MIMETypes, mediaType):
+		return encPEM | encDER, nil
+	case mediaType == "application/x-www-form-urlencoded":
+		return encAny, nil
+	}
+	return 0, fmt.Errorf("Content-Type %s cannot hold a %s", mediaType, kind.Name)
+}
+
+// decodeObject finds kind in data, trying each of encodings.
+func decodeObject(data []byte, encodings int, kind bodyKind) (*pem.Block, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("Request body is empty, expected a %s", kind.Name)
+	}
+
+	if bytes.HasPrefix(trimmed, []byte("-----BEGIN ")) {
+		if encodings&encPEM == 0 {
+			return nil, fmt.Errorf("Received PEM, but the Content-Type calls for %s", encodingNames(encodings))
+		}
+		rest := trimmed
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				return nil, fmt.Errorf("Failed to decode PEM %s (expected a block of type %s)", kind.Name, strings.Join(kind.PEMTypes, ", "))
+			}
+			if slices.Contains(kind.PEMTypes, block.Type) {
+				return block, nil
+			}
+		}
+	}
+
+	der := data
+	if encodings&encBase64 != 0 {
+		decoded, err := decodeBase64(trimmed)
+		if err == nil {
+			der = decoded
+		} else if encodings&encDER == 0 {
+			return nil, fmt.Errorf("Failed to decode base64 %s: %v", kind.Name, err)
+		}
+	} else if encodings&encDER == 0 {
+		return nil, fmt.Errorf("Expected %s, but the body is not PEM", encodingNames(encodings))
+	}
+	return &pem.Block{Type: derBlockType(der, kind), Bytes: der}, nil
+}
+
+// decodeBase64 accepts standard or URL-safe base64, with or without padding or line breaks.
+func decodeBase64(data []byte) ([]byte, error) {
+	s := strings.Join(strings.Fields(string(data)), "")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// derBlockType returns the PEM type for a DER object. Private keys come in several formats, so
+// they are parsed to find out which.
+func derBlockType(der []byte, kind bodyKind) string {
+	if kind.Name == keyBody.Name {
+		if _, err := x509.ParseECPrivateKey(der); err == nil {
+			return "EC PRIVATE KEY"
+		}
+		if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+			return "RSA PRIVATE KEY"
+		}
+	}
+	return kind.PEMTypes[0]
+}
+
+func encodingNames(encodings int) string {
+	var names []string
+	for _, enc := range []struct {
+		bit  int
+		name string
+	}{{encPEM, "PEM"}, {encDER, "DER"}, {encBase64, "base64"}} {
+		if encodings&enc.bit != 0 {
+			names = append(names, enc.name)
+		}
+	}
+	return strings.Join(names, " or ")
+}
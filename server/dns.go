@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/9072997/tlspage"
 	"github.com/9072997/tlspage/dnspriv"
 	"github.com/9072997/tlspage/madns"
 	"github.com/miekg/dns"
@@ -20,8 +21,7 @@ type DNSBackend struct {
 	Origin        string
 	StaticRecords map[string][]dns.RR
 
-	db              *sql.DB
-	wildcardDNSName regexp.Regexp
+	db *sql.DB
 }
 
 // This populates ZoneData, which is not thread-safe
@@ -60,12 +60,6 @@ func NewDNSBackend(origin, zoneFile string, db *sql.DB) (DNSBackend, error) {
 	}
 	log.Printf("Loaded %d records from zone file", rCount)
 
-	// compile the regex for wildcard DNS names
-	escapedOrigin := regexp.QuoteMeta(origin)
-	wildcardDNSName := regexp.MustCompile(
-		`^[0-9a-f-]{3,45}\.[0-9a-f]{32}\.[0-9a-f]{32}\.` + escapedOrigin + `\.$`,
-	)
-
 	// create validation records table if it does not exist
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS validation_records (
@@ -80,10 +74,9 @@ func NewDNSBackend(origin, zoneFile string, db *sql.DB) (DNSBackend, error) {
 	}
 
 	return DNSBackend{
-		Origin:          origin,
-		StaticRecords:   staticRecords,
-		db:              db,
-		wildcardDNSName: *wildcardDNSName,
+		Origin:        origin,
+		StaticRecords: staticRecords,
+		db:            db,
 	}, nil
 }
 
@@ -125,6 +118,22 @@ func (b DNSBackend) GetValidationRecord(qname string) (string, error) {
 	return value, nil
 }
 
+var fingerprintLabel = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// hasIPLabel reports whether qname is in the IP label position under a key-pinned base name,
+// where only valid IP labels exist. A literal "*" label is left to the static records.
+func (b DNSBackend) hasIPLabel(qname string) bool {
+	labels, ok := strings.CutSuffix(qname, "."+dns.CanonicalName(b.Origin))
+	if !ok {
+		return false
+	}
+	parts := strings.Split(labels, ".")
+	return len(parts) == 3 &&
+		parts[0] != "*" &&
+		fingerprintLabel.MatchString(parts[1]) &&
+		fingerprintLabel.MatchString(parts[2])
+}
+
 func (b DNSBackend) Lookup(qname, streamIsolationID string) (rr []dns.RR, err error) {
 	qname = dns.CanonicalName(qname)
 
@@ -149,7 +158,14 @@ func (b DNSBackend) Lookup(qname, streamIsolationID string) (rr []dns.RR, err er
 	}
 
 	// handle ipv4 and ipv6 records
-	if b.wildcardDNSName.MatchString(qname) {
+	if b.hasIPLabel(qname) {
+		pinned, err := tlspage.ParseHostname(qname, b.Origin)
+		if err != nil {
+			// the name is not a valid IP address
+			// NXDOMAIN response
+			return nil, nil
+		}
+
 		// CAA to prevent anyone from getting a cert for the name directly
 		rr = []dns.RR{
 			&dns.CAA{
@@ -165,10 +181,7 @@ func (b DNSBackend) Lookup(qname, streamIsolationID string) (rr []dns.RR, err er
 			},
 		}
 
-		ipPart, _, _ := strings.Cut(qname, ".")
-		// try as IPv4
-		parsed := net.ParseIP(strings.ReplaceAll(ipPart, "-", "."))
-		if parsed != nil {
+		if len(pinned.IP) == net.IPv4len {
 			rr = append(rr, &dns.A{
 				Hdr: dns.RR_Header{
 					Name:   qname,
@@ -176,30 +189,22 @@ func (b DNSBackend) Lookup(qname, streamIsolationID string) (rr []dns.RR, err er
 					Class:  dns.ClassINET,
 					Ttl:    30 * 24 * 60 * 60, // 30 days
 				},
-				A: parsed.To4(),
+				A: pinned.IP,
 			})
-			return
+			return rr, nil
 		}
 
-		// try as IPv6
-		parsed = net.ParseIP(strings.ReplaceAll(ipPart, "-", ":"))
-		if parsed != nil {
-			// this is an IPv6 address
-			rr = append(rr, &dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   qname,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    30 * 24 * 60 * 60, // 30 days
-				},
-				AAAA: parsed.To16(),
-			})
-			return
-		}
-
-		// if we reach here, the name is not a valid IP address
-		// NXDOMAIN response
-		return nil, nil
+		// this is an IPv6 address
+		rr = append(rr, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    30 * 24 * 60 * 60, // 30 days
+			},
+			AAAA: pinned.IP.To16(),
+		})
+		return rr, nil
 	}
 
 	// handle static records
@@ -24,6 +24,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/9072997/tlspage"
 	"github.com/canonical/go-dqlite/v3/app"
 	"github.com/canonical/go-dqlite/v3/client"
 )
@@ -32,28 +33,15 @@ const DBName = "tlspage.sqlite3"
 
 func myIPv6() (net.IP, error) {
 	for i := range 2 {
-		ifaces, err := net.Interfaces()
+		ips, err := tlspage.InterfaceAddrs()
 		if err != nil {
 			return nil, err
 		}
-		for _, iface := range ifaces {
-			addrs, err := iface.Addrs()
-			if err != nil {
+		for _, ip := range ips {
+			if ip.To4() != nil {
 				continue
 			}
-			for _, addr := range addrs {
-				ipnet, ok := addr.(*net.IPNet)
-				if !ok {
-					continue
-				}
-				if ipnet.IP.To4() != nil {
-					continue
-				}
-				if !ipnet.IP.IsGlobalUnicast() {
-					continue
-				}
-				return ipnet.IP, nil
-			}
+			return ip, nil
 		}
 		if i == 0 {
 			// wait a bit before trying again
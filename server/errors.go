@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// codedError attaches a machine-readable code, reported by the /v2/ API, to an error. The
+// message is unchanged, so the v1 endpoints report it as before.
+type codedError struct {
+	Code string
+	Err  error
+}
+
+func (e *codedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.Err
+}
+
+// errorStatuses maps error codes to HTTP statuses. Errors without a code are internal_error.
+var errorStatuses = map[string]int{
+	"invalid_request":        http.StatusBadRequest,
+	"invalid_csr":            http.StatusBadRequest,
+	"invalid_key":            http.StatusBadRequest,
+	"invalid_certificate":    http.StatusBadRequest,
+	"csr_name_mismatch":      http.StatusBadRequest,
+	"key_type_not_allowed":   http.StatusBadRequest,
+	"not_found":              http.StatusNotFound,
+	"method_not_allowed":     http.StatusMethodNotAllowed,
+	"request_too_large":      http.StatusRequestEntityTooLarge,
+	"unsupported_media_type": http.StatusUnsupportedMediaType,
+	"acme_rate_limited":      http.StatusTooManyRequests,
+	"acme_error":             http.StatusBadGateway,
+	"internal_error":         http.StatusInternalServerError,
+	"unhealthy":              http.StatusServiceUnavailable,
+}
+
+// errorCode returns the code of the first codedError in err's chain, or internal_error.
+func errorCode(err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	return "internal_error"
+}
+
+// errorStatus returns the HTTP status for err's code.
+func errorStatus(err error) int {
+	return errorStatuses[errorCode(err)]
+}
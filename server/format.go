@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// certFormat is a way of returning an issued certificate chain.
+type certFormat struct {
+	Name        string
+	ContentType string
+	Suffix      string // appended to the base of the download's filename
+}
+
+var (
+	formatFullChain = certFormat{"fullchain", "application/x-x509-ca-cert", ".pem"}
+	certFormats     = []certFormat{
+		formatFullChain,
+		{"leaf", "application/x-pem-file", ".leaf.pem"},
+		{"chain", "application/x-pem-file", ".chain.pem"}, // intermediates, without the leaf
+		{"der", "application/pkix-cert", ".der"},          // leaf only
+		{"p7b", "application/x-pkcs7-certificates", ".p7b"},
+		{"json", "application/json", ""},
+	}
+
+	// media types clients may send in Accept, and the format each selects
+	acceptFormats = map[string]string{
+		"application/x-x509-ca-cert":        "fullchain",
+		"application/pem-certificate-chain": "fullchain",
+		"application/x-pem-file":            "fullchain",
+		"application/pkix-cert":             "der",
+		"application/x-x509-user-cert":      "der",
+		"application/x-pkcs7-certificates":  "p7b",
+		"application/pkcs7-mime":            "p7b",
+		"application/json":                  "json",
+	}
+)
+
+// negotiateCertFormat picks the format for a certificate response from the format query
+// parameter, or failing that the Accept header. The full PEM chain is the default, including
+// when Accept only lists types we don't have, since that is what browsers and older clients
+// expect.
+func negotiateCertFormat(req *http.Request) (certFormat, error) {
+	name := req.URL.Query().Get("format")
+	if name == "" {
+		name = acceptedFormat(req.Header.Get("Accept"))
+	}
+	if name == "" {
+		return formatFullChain, nil
+	}
+
+	for _, format := range certFormats {
+		if format.Name == name {
+			return format, nil
+		}
+	}
+	var names []string
+	for _, format := range certFormats {
+		names = append(names, format.Name)
+	}
+	return certFormat{}, fmt.Errorf("Unknown format %q (expected one of %s)", name, strings.Join(names, ", "))
+}
+
+// acceptedFormat returns the format for the most preferred media type in an Accept header that
+// we have a format for, or "" if there is none.
+func acceptedFormat(accept string) string {
+	type choice struct {
+		format string
+		q      float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := acceptFormats[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{format, q})
+		}
+	}
+	if len(choices) == 0 {
+		return ""
+	}
+
+	// the first of the most preferred
+	slices.SortStableFunc(choices, func(a, b choice) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+	return choices[0].format
+}
+
+// writeCert writes the PEM chain from RequestCert in format. filename is the name of the
+// download without an extension.
+func writeCert(resp http.ResponseWriter, format certFormat, filename, baseName string, chainPEM []byte, fromCache bool) {
+	resp.Header().Add("Vary", "Accept")
+
+	var body []byte
+	var err error
+	switch format.Name {
+	case "fullchain":
+		body = chainPEM
+	case "leaf", "chain", "der", "p7b":
+		var ders [][]byte
+		ders, err = chainDERs(chainPEM)
+		if err != nil {
+			break
+		}
+		switch format.Name {
+		case "leaf":
+			body = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ders[0]})
+		case "chain":
+			for _, der := range ders[1:] {
+				body = append(body, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+			}
+		case "der":
+			body = ders[0]
+		case "p7b":
+			body, err = marshalPKCS7(ders)
+		}
+	case "json":
+		var r *certResponse
+		r, err = newCertResponse(baseName, chainPEM, fromCache)
+		if err == nil {
+			writeV2JSON(resp, http.StatusOK, r)
+			return
+		}
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to encode certificate as %s: %v", format.Name, err)
+		http.Error(resp, errMsg, http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", format.ContentType)
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s%s\"", filename, format.Suffix))
+	resp.Write(body)
+}
+
+// chainDERs returns the certificates in a PEM chain, leaf first.
+func chainDERs(chainPEM []byte) ([][]byte, error) {
+	var ders [][]byte
+	rest := chainPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("no certificate in chain")
+	}
+	return ders, nil
+}
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// marshalPKCS7 returns a "certs-only" PKCS#7 bundle (RFC 2315 SignedData with no content or
+// signers) of DER certificates, which is what .p7b files are.
+func marshalPKCS7(ders [][]byte) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) { // ContentInfo
+		b.AddASN1ObjectIdentifier(oidPKCS7SignedData)
+		b.AddASN1(cryptobyte_asn1.Tag(0).Constructed().ContextSpecific(), func(b *cryptobyte.Builder) {
+			b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) { // SignedData
+				b.AddASN1Int64(1)                                              // version
+				b.AddASN1(cryptobyte_asn1.SET, func(b *cryptobyte.Builder) {}) // digestAlgorithms
+				b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidPKCS7Data) // contentInfo with no content
+				})
+				b.AddASN1(cryptobyte_asn1.Tag(0).Constructed().ContextSpecific(), func(b *cryptobyte.Builder) {
+					for _, der := range ders {
+						b.AddBytes(der)
+					}
+				})
+				b.AddASN1(cryptobyte_asn1.SET, func(b *cryptobyte.Builder) {}) // signerInfos
+			})
+		})
+	})
+	return b.Bytes()
+}
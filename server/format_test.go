@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testChain returns a PEM chain of a leaf for "*."+baseName and the CA that issued it, and the
+// two certificates in DER.
+func testChain(t *testing.T, baseName string) ([]byte, [][]byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now,
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(0xabc),
+		Subject:      pkix.Name{CommonName: "*." + baseName},
+		DNSNames:     []string{"*." + baseName},
+		NotBefore:    now,
+		NotAfter:     now.Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chainPEM []byte
+	for _, der := range [][]byte{leafDER, caDER} {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return chainPEM, [][]byte{leafDER, caDER}
+}
+
+func TestAcceptedFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", ""},
+		{"application/json", "json"},
+		{"application/pkix-cert", "der"},
+		{"application/x-x509-user-cert", "der"},
+		{"application/pkcs7-mime", "p7b"},
+		{"application/pem-certificate-chain", "fullchain"},
+		{"text/html, application/x-pkcs7-certificates", "p7b"},
+		{"application/json;q=0.5, application/pkix-cert", "der"},
+		{"application/json;q=0.9, application/pkix-cert;q=0.9", "json"},
+		{"application/json;q=0, application/pkix-cert;q=0.1", "der"},
+		{"application/json;q=oops, application/pkix-cert;q=0.1", "der"},
+		{"application/json;q=0", ""},
+		{"garbage;;", ""},
+	}
+	for _, tt := range tests {
+		if got := acceptedFormat(tt.accept); got != tt.want {
+			t.Errorf("acceptedFormat(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateCertFormat(t *testing.T) {
+	tests := []struct {
+		query   string
+		accept  string
+		want    string
+		wantErr bool
+	}{
+		{"", "", "fullchain", false},
+		{"", "text/html", "fullchain", false},
+		{"", "application/json", "json", false},
+		{"?format=leaf", "", "leaf", false},
+		{"?format=chain", "application/json", "chain", false}, // the query parameter wins
+		{"?format=der", "", "der", false},
+		{"?format=p7b", "", "p7b", false},
+		{"?format=pfx", "", "", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/cert/example"+tt.query, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		format, err := negotiateCertFormat(req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("negotiateCertFormat(%q, Accept %q) error = %v, wantErr %v", tt.query, tt.accept, err, tt.wantErr)
+			continue
+		}
+		if format.Name != tt.want {
+			t.Errorf("negotiateCertFormat(%q, Accept %q) = %s, want %s", tt.query, tt.accept, format.Name, tt.want)
+		}
+	}
+}
+
+// pkcs7SignedData is the part of RFC 2315 SignedData a certs-only bundle uses. It is parsed with
+// encoding/asn1 so the test doesn't share code with marshalPKCS7.
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+	Certificates     asn1.RawValue `asn1:"tag:0"`
+	SignerInfos      asn1.RawValue
+}
+
+func TestMarshalPKCS7(t *testing.T) {
+	_, ders := testChain(t, "example.tls.page")
+	p7b, err := marshalPKCS7(ders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	rest, err := asn1.Unmarshal(p7b, &contentInfo)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("failed to parse ContentInfo: %v (%d trailing bytes)", err, len(rest))
+	}
+	if !contentInfo.ContentType.Equal(oidPKCS7SignedData) {
+		t.Errorf("content type = %v, want signedData", contentInfo.ContentType)
+	}
+	var signedData pkcs7SignedData
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	if err != nil {
+		t.Fatalf("failed to parse SignedData: %v", err)
+	}
+	if signedData.Version != 1 || !signedData.ContentInfo.ContentType.Equal(oidPKCS7Data) {
+		t.Errorf("SignedData version %d, content type %v, want 1, data", signedData.Version, signedData.ContentInfo.ContentType)
+	}
+	if len(signedData.DigestAlgorithms.Bytes) != 0 || len(signedData.SignerInfos.Bytes) != 0 {
+		t.Errorf("certs-only bundle has digest algorithms or signers")
+	}
+	certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse certificates: %v", err)
+	}
+	if len(certs) != len(ders) {
+		t.Fatalf("bundle has %d certificates, want %d", len(certs), len(ders))
+	}
+	for i, cert := range certs {
+		if !bytes.Equal(cert.Raw, ders[i]) {
+			t.Errorf("certificate %d differs from the input", i)
+		}
+	}
+
+	// and through a real PKCS#7 implementation, if there is one
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	cmd := exec.Command(openssl, "pkcs7", "-inform", "DER", "-print_certs")
+	cmd.Stdin = bytes.NewReader(p7b)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("openssl pkcs7 failed to parse the bundle: %v", err)
+	}
+	var got [][]byte
+	for {
+		var block *pem.Block
+		block, out = pem.Decode(out)
+		if block == nil {
+			break
+		}
+		got = append(got, block.Bytes)
+	}
+	if len(got) != len(ders) || !bytes.Equal(got[0], ders[0]) || !bytes.Equal(got[1], ders[1]) {
+		t.Errorf("openssl pkcs7 returned %d certificates, want the %d in the chain", len(got), len(ders))
+	}
+}
+
+func TestWriteCert(t *testing.T) {
+	const baseName = "9b7d8f4b4f45183149c1b666d08d1f8c.bfcd0704a087908e509c39b1c2b98cc5.tls.page"
+	chainPEM, ders := testChain(t, baseName)
+
+	for _, format := range certFormats {
+		t.Run(format.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeCert(rec, format, baseName, baseName, chainPEM, true)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != format.ContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, format.ContentType)
+			}
+			if rec.Header().Get("Vary") != "Accept" {
+				t.Errorf("Vary = %q, want Accept", rec.Header().Get("Vary"))
+			}
+			if format.Name != "json" && !strings.Contains(rec.Header().Get("Content-Disposition"), `"`+baseName+format.Suffix+`"`) {
+				t.Errorf("Content-Disposition = %q", rec.Header().Get("Content-Disposition"))
+			}
+
+			body := rec.Body.Bytes()
+			switch format.Name {
+			case "fullchain":
+				if !bytes.Equal(body, chainPEM) {
+					t.Errorf("body is not the full chain")
+				}
+			case "leaf", "chain":
+				want := ders[:1]
+				if format.Name == "chain" {
+					want = ders[1:]
+				}
+				block, rest := pem.Decode(body)
+				if block == nil || !bytes.Equal(block.Bytes, want[0]) || len(bytes.TrimSpace(rest)) != 0 {
+					t.Errorf("body = %q, want one PEM certificate", body)
+				}
+			case "der":
+				if !bytes.Equal(body, ders[0]) {
+					t.Errorf("body is not the DER leaf")
+				}
+			case "p7b":
+				want, err := marshalPKCS7(ders)
+				if err != nil || !bytes.Equal(body, want) {
+					t.Errorf("body is not the PKCS#7 bundle")
+				}
+			case "json":
+				var r certResponse
+				err := json.Unmarshal(body, &r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.BaseName != baseName || len(r.Chain) != 2 || r.Serial != "abc" || !r.FromCache {
+					t.Errorf("JSON = %+v", r)
+				}
+			}
+		})
+	}
+}
@@ -6,11 +6,11 @@ import (
 	"embed"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"math/rand"
 	"net"
 	"net/http"
-	"strings"
+	"slices"
+	"strconv"
 
 	"github.com/9072997/tlspage"
 )
@@ -18,33 +18,34 @@ import (
 //go:embed apidocs
 var apidocs embed.FS
 
-func serveAPIDocs(resp http.ResponseWriter, name string) {
-	data, err := apidocs.ReadFile("apidocs/" + name)
-	if err != nil {
-		errMsg := fmt.Sprintf("Failed to read API documentation: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+// serveAPIDocs serves one or more documentation files, separated by blank lines. Endpoints add
+// the shared sections (such as "request-body") that apply to them.
+func serveAPIDocs(resp http.ResponseWriter, names ...string) {
+	var docs [][]byte
+	for _, name := range names {
+		data, err := apidocs.ReadFile("apidocs/" + name)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read API documentation: %v", err)
+			http.Error(resp, errMsg, http.StatusInternalServerError)
+			return
+		}
+		docs = append(docs, data)
 	}
 	resp.Header().Set("Content-Type", "text/plain")
-	resp.Write(data)
+	resp.Write(bytes.Join(docs, []byte("\n")))
 }
 
 func (h *HTTPHandler) hostnameFromCertHandler(resp http.ResponseWriter, req *http.Request) {
-	if req.Method == http.MethodGet || req.Method == http.MethodHead {
-		serveAPIDocs(resp, "hostname-from-cert")
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead, http.MethodPost) {
 		return
 	}
-
-	certData, err := io.ReadAll(req.Body)
-	if err != nil {
-		http.Error(resp, "Failed to read request body", http.StatusInternalServerError)
+	if req.Method != http.MethodPost {
+		serveAPIDocs(resp, "hostname-from-cert", "request-body")
 		return
 	}
-	req.Body.Close()
 
-	block, _ := pem.Decode(certData)
-	if block == nil {
-		http.Error(resp, "Failed to decode PEM certificate", http.StatusBadRequest)
+	block, ok := decodeBody(resp, req, certBody)
+	if !ok {
 		return
 	}
 
@@ -55,45 +56,52 @@ func (h *HTTPHandler) hostnameFromCertHandler(resp http.ResponseWriter, req *htt
 		return
 	}
 
-	hostname := cert.Subject.CommonName
-	if hostname == "" && len(cert.DNSNames) > 0 {
-		hostname = cert.DNSNames[0]
-	}
-	if hostname == "" {
-		http.Error(resp, "No common name or DNS names found in certificate", http.StatusBadRequest)
+	hostname, err := tlspage.HostnameFromCertificate(cert, h.DNSBackend.Origin)
+	if err != nil {
+		errMsg := fmt.Sprintf("Certificate is not key-pinned: %v", err)
+		http.Error(resp, errMsg, http.StatusBadRequest)
 		return
 	}
 
-	hostname = strings.TrimPrefix(hostname, "*.")
-
 	resp.Header().Set("Content-Type", "text/plain")
 	resp.Write([]byte(hostname))
 }
 
-func (h *HTTPHandler) hostnameFromCSRHandler(resp http.ResponseWriter, req *http.Request) {
-	if req.Method == http.MethodGet || req.Method == http.MethodHead {
-		serveAPIDocs(resp, "hostname-from-csr")
-		return
+// requestedKeyType returns the key type in the type query parameter of a /key request. The
+// default is ECDSA P-256, or the first allowed key type if the configuration doesn't allow it.
+func requestedKeyType(req *http.Request) (tlspage.KeyType, error) {
+	t := req.URL.Query().Get("type")
+	if t == "" {
+		if len(AllowedKeyTypes) == 0 || slices.Contains(AllowedKeyTypes, string(tlspage.KeyTypeECDSAP256)) {
+			return tlspage.KeyTypeECDSAP256, nil
+		}
+		t = AllowedKeyTypes[0]
 	}
 
-	csrData, err := io.ReadAll(req.Body)
+	keyType, err := tlspage.ParseKeyType(t)
 	if err != nil {
-		http.Error(resp, "Failed to read request body", http.StatusInternalServerError)
+		return "", &codedError{"invalid_request", err}
+	}
+	if !slices.Contains(AllowedKeyTypes, string(keyType)) {
+		return "", &codedError{"key_type_not_allowed", fmt.Errorf("Key type %s is not accepted by the configured CA", keyType)}
+	}
+	return keyType, nil
+}
+
+func (h *HTTPHandler) hostnameFromCSRHandler(resp http.ResponseWriter, req *http.Request) {
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead, http.MethodPost) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		serveAPIDocs(resp, "hostname-from-csr", "request-body")
 		return
 	}
-	req.Body.Close()
 
-	var csr []byte
-	if bytes.Contains(csrData, []byte("----")) {
-		block, _ := pem.Decode(csrData)
-		if block == nil {
-			http.Error(resp, "Failed to decode PEM CSR", http.StatusBadRequest)
-			return
-		}
-		csr = block.Bytes
-	} else {
-		csr = csrData
+	block, ok := decodeBody(resp, req, csrBody)
+	if !ok {
+		return
 	}
+	csr := block.Bytes
 
 	baseName, err := CSRPinnedBaseName(csr, h.DNSBackend.Origin)
 	if err != nil {
@@ -115,27 +123,28 @@ func (h *HTTPHandler) hostnameFromCSRHandler(resp http.ResponseWriter, req *http
 }
 
 func (h *HTTPHandler) hostnameFromKeyHandler(resp http.ResponseWriter, req *http.Request) {
-	if req.Method == http.MethodGet || req.Method == http.MethodHead {
-		serveAPIDocs(resp, "hostname-from-key")
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead, http.MethodPost) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		serveAPIDocs(resp, "hostname-from-key", "request-body")
 		return
 	}
 
-	keyData, err := io.ReadAll(req.Body)
-	if err != nil {
-		http.Error(resp, "Failed to read request body", http.StatusInternalServerError)
+	block, ok := decodeBody(resp, req, keyBody)
+	if !ok {
 		return
 	}
-	req.Body.Close()
 
-	hostname, err := tlspage.Hostname(string(keyData), h.DNSBackend.Origin)
+	hostname, csr, err := KeyPinnedCSR(string(pem.EncodeToMemory(block)), h.DNSBackend.Origin)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to extract hostname: %v", err)
 		http.Error(resp, errMsg, http.StatusBadRequest)
 		return
 	}
 
-	// just in-case this is the first time we see this key generate a CSR and cache it
-	err = h.ACME.cache.PutKey(string(keyData), h.DNSBackend.Origin)
+	// just in-case this is the first time we see this key cache the CSR
+	err = h.ACME.cache.PutCSR(csr, h.DNSBackend.Origin)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to cache CSR: %v", err)
 		http.Error(resp, errMsg, http.StatusInternalServerError)
@@ -147,35 +156,24 @@ func (h *HTTPHandler) hostnameFromKeyHandler(resp http.ResponseWriter, req *http
 }
 
 func (h *HTTPHandler) certFromCSRHandler(resp http.ResponseWriter, req *http.Request) {
-	if req.Method == http.MethodGet || req.Method == http.MethodHead {
-		serveAPIDocs(resp, "cert-from-csr")
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead, http.MethodPost) {
 		return
 	}
-
-	// CSR should never be larger than 10KB
-	if req.ContentLength > 10*1024 {
-		http.Error(resp, "Request too large", http.StatusRequestEntityTooLarge)
+	if req.Method != http.MethodPost {
+		serveAPIDocs(resp, "cert-from-csr", "request-body", "cert-formats", "async")
 		return
 	}
-
-	reqBody, err := io.ReadAll(req.Body)
+	format, err := negotiateCertFormat(req)
 	if err != nil {
-		http.Error(resp, "Failed to read request body", http.StatusInternalServerError)
+		http.Error(resp, err.Error(), http.StatusBadRequest)
 		return
 	}
-	req.Body.Close()
 
-	var csr []byte
-	if bytes.Contains(reqBody, []byte("----")) {
-		block, _ := pem.Decode(reqBody)
-		if block == nil {
-			http.Error(resp, "Failed to decode PEM CSR", http.StatusBadRequest)
-			return
-		}
-		csr = block.Bytes
-	} else {
-		csr = reqBody
+	block, ok := decodeBody(resp, req, csrBody)
+	if !ok {
+		return
 	}
+	csr := block.Bytes
 
 	baseName, err := CSRPinnedBaseName(csr, h.DNSBackend.Origin)
 	if err != nil {
@@ -184,107 +182,115 @@ func (h *HTTPHandler) certFromCSRHandler(resp http.ResponseWriter, req *http.Req
 		return
 	}
 
+	// slow orders can outlast the connection, so clients may ask to poll for the result instead
+	if async, _ := strconv.ParseBool(req.URL.Query().Get("async")); async {
+		h.startOrder(resp, baseName, csr)
+		return
+	}
+
 	// also caches the CSR
-	cert, err := h.ACME.RequestCert(req.Context(), baseName, csr, h.DNSBackend)
+	cert, fromCache, err := h.ACME.RequestCert(req.Context(), baseName, csr, h.DNSBackend)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to get certificate: %v", err)
 		http.Error(resp, errMsg, http.StatusInternalServerError)
 		return
 	}
 
-	resp.Header().Set("Content-Type", "application/x-x509-ca-cert")
-	resp.Header().Set("Content-Disposition", "attachment; filename=\"cert.pem\"")
-	resp.Write(cert)
+	writeCert(resp, format, "cert", baseName, cert, fromCache)
 }
 
 func (h *HTTPHandler) certFromKeyHandler(resp http.ResponseWriter, req *http.Request) {
-	if req.Method == http.MethodGet || req.Method == http.MethodHead {
-		serveAPIDocs(resp, "cert-from-key")
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead, http.MethodPost) {
 		return
 	}
-
-	keyData, err := io.ReadAll(req.Body)
+	if req.Method != http.MethodPost {
+		serveAPIDocs(resp, "cert-from-key", "request-body", "cert-formats", "async")
+		return
+	}
+	format, err := negotiateCertFormat(req)
 	if err != nil {
-		http.Error(resp, "Failed to read request body", http.StatusInternalServerError)
+		http.Error(resp, err.Error(), http.StatusBadRequest)
 		return
 	}
-	req.Body.Close()
 
-	hostname, err := tlspage.Hostname(string(keyData), h.DNSBackend.Origin)
-	if err != nil {
-		errMsg := fmt.Sprintf("Failed to generate hostname: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
+	block, ok := decodeBody(resp, req, keyBody)
+	if !ok {
 		return
 	}
 
-	csr, err := tlspage.GenerateCSR(string(keyData), hostname)
+	hostname, csr, err := KeyPinnedCSR(string(pem.EncodeToMemory(block)), h.DNSBackend.Origin)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to generate CSR: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
+		http.Error(resp, errMsg, http.StatusBadRequest)
 		return
 	}
 
-	block, _ := pem.Decode([]byte(csr))
-	if block == nil {
-		http.Error(resp, "Failed to decode PEM CSR", http.StatusBadRequest)
+	if async, _ := strconv.ParseBool(req.URL.Query().Get("async")); async {
+		h.startOrder(resp, hostname, csr)
 		return
 	}
 
 	// this will also cache the CSR
-	cert, err := h.ACME.RequestCert(req.Context(), hostname, block.Bytes, h.DNSBackend)
+	cert, fromCache, err := h.ACME.RequestCert(req.Context(), hostname, csr, h.DNSBackend)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to get certificate: %v", err)
 		http.Error(resp, errMsg, http.StatusInternalServerError)
 		return
 	}
 
-	resp.Header().Set("Content-Type", "application/x-x509-ca-cert")
-	resp.Header().Set("Content-Disposition", "attachment; filename=\"cert.pem\"")
-	resp.Write(cert)
+	writeCert(resp, format, "cert", hostname, cert, fromCache)
 }
 
 func (h *HTTPHandler) csrFromKeyHandler(resp http.ResponseWriter, req *http.Request) {
-	if req.Method == http.MethodGet || req.Method == http.MethodHead {
-		serveAPIDocs(resp, "csr-from-key")
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead, http.MethodPost) {
 		return
 	}
-
-	keyData, err := io.ReadAll(req.Body)
-	if err != nil {
-		http.Error(resp, "Failed to read request body", http.StatusInternalServerError)
+	if req.Method != http.MethodPost {
+		serveAPIDocs(resp, "csr-from-key", "request-body")
 		return
 	}
-	req.Body.Close()
 
-	hostname, err := tlspage.Hostname(string(keyData), h.DNSBackend.Origin)
-	if err != nil {
-		errMsg := fmt.Sprintf("Failed to generate hostname: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
+	block, ok := decodeBody(resp, req, keyBody)
+	if !ok {
 		return
 	}
 
-	csr, err := tlspage.GenerateCSR(string(keyData), hostname)
+	_, csr, err := KeyPinnedCSR(string(pem.EncodeToMemory(block)), h.DNSBackend.Origin)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to generate CSR: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
+		http.Error(resp, errMsg, http.StatusBadRequest)
 		return
 	}
 
 	// cache the CSR
-	err = h.ACME.cache.PutCSR([]byte(csr), h.DNSBackend.Origin)
+	err = h.ACME.cache.PutCSR(csr, h.DNSBackend.Origin)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to cache CSR: %v", err)
 		http.Error(resp, errMsg, http.StatusInternalServerError)
 		return
 	}
 
+	csrPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr,
+	})
 	resp.Header().Set("Content-Type", "application/x-pem-file")
 	resp.Header().Set("Content-Disposition", "attachment; filename=\"csr.pem\"")
-	resp.Write([]byte(csr))
+	resp.Write(csrPEM)
 }
 
 func (h *HTTPHandler) keyHandler(resp http.ResponseWriter, req *http.Request) {
-	key, err := tlspage.GenerateKey()
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead) {
+		return
+	}
+
+	keyType, err := requestedKeyType(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, err := tlspage.GenerateKeyWithType(keyType)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to generate key: %v", err)
 		http.Error(resp, errMsg, http.StatusInternalServerError)
@@ -305,7 +311,15 @@ func (h *HTTPHandler) keyHandler(resp http.ResponseWriter, req *http.Request) {
 }
 
 func (h *HTTPHandler) certForHostnameHandler(resp http.ResponseWriter, req *http.Request) {
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead) {
+		return
+	}
 	hostname := req.URL.Path[len("/cert/"):]
+	format, err := negotiateCertFormat(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	csr, _, _, err := h.ACME.cache.Get("*." + hostname)
 	if err != nil {
@@ -318,21 +332,36 @@ func (h *HTTPHandler) certForHostnameHandler(resp http.ResponseWriter, req *http
 		return
 	}
 
-	cert, err := h.ACME.RequestCert(req.Context(), hostname, csr, h.DNSBackend)
+	cert, fromCache, err := h.ACME.RequestCert(req.Context(), hostname, csr, h.DNSBackend)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to retrieve certificate: %v", err)
 		http.Error(resp, errMsg, http.StatusInternalServerError)
 		return
 	}
 
-	resp.Header().Set("Content-Type", "application/x-x509-ca-cert")
-	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.pem\"", hostname))
-	resp.Write(cert)
+	writeCert(resp, format, hostname, hostname, cert, fromCache)
 }
 
 // the idea is that this should perform a number of health checks that are
 // cheap enough to safely expose to the internet.
 func (h *HTTPHandler) statusHandler(resp http.ResponseWriter, req *http.Request) {
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead) {
+		return
+	}
+
+	err := h.checkHealth()
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte("OK\n"))
+}
+
+// checkHealth sets a random TXT record and checks that it can be read back from the database
+// and from DNS.
+func (h *HTTPHandler) checkHealth() error {
 	// create a random TXT record and check propagation
 	qname := fmt.Sprintf(
 		"_acme-challenge.healthcheck-%d.%s.",
@@ -342,43 +371,27 @@ func (h *HTTPHandler) statusHandler(resp http.ResponseWriter, req *http.Request)
 	value := fmt.Sprint(rand.Int63())
 	err := h.DNSBackend.SetValidationRecord(qname, value)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to set validation record: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+		return fmt.Errorf("Failed to set validation record: %v", err)
 	}
 	valueFromDB, err := h.DNSBackend.GetValidationRecord(qname)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to get validation record from DB: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+		return fmt.Errorf("Failed to get validation record from DB: %v", err)
 	}
 	if string(valueFromDB) != value {
-		errMsg := fmt.Sprintf("Validation record value mismatch in DB: expected %s, got %s", value, valueFromDB)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+		return fmt.Errorf("Validation record value mismatch in DB: expected %s, got %s", value, valueFromDB)
 	}
 	valuesFromDNS, err := net.LookupTXT(qname)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to lookup TXT record from DNS: %v", err)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+		return fmt.Errorf("Failed to lookup TXT record from DNS: %v", err)
 	}
 	if len(valuesFromDNS) == 0 {
-		errMsg := fmt.Sprintf("No TXT records found for %s", qname)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+		return fmt.Errorf("No TXT records found for %s", qname)
 	}
 	if len(valuesFromDNS) > 1 {
-		errMsg := fmt.Sprintf("Multiple TXT records found for %s: %v", qname, valuesFromDNS)
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+		return fmt.Errorf("Multiple TXT records found for %s: %v", qname, valuesFromDNS)
 	}
 	if valuesFromDNS[0] != value {
-		errMsg := fmt.Sprintf("TXT record value mismatch in DNS: expected %s, got %s", value, valuesFromDNS[0])
-		http.Error(resp, errMsg, http.StatusInternalServerError)
-		return
+		return fmt.Errorf("TXT record value mismatch in DNS: expected %s, got %s", value, valuesFromDNS[0])
 	}
-
-	resp.Header().Set("Content-Type", "text/plain")
-	resp.Write([]byte("OK\n"))
+	return nil
 }
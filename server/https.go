@@ -12,6 +12,7 @@ type HTTPHandler struct {
 	ACME       ACME
 	DNSBackend DNSBackend
 	CertCache  *AutoCertCache
+	Orders     *OrderStore
 	mux        *http.ServeMux
 }
 
@@ -35,7 +36,9 @@ func (h *HTTPHandler) ListenAndServe() error {
 	h.mux.HandleFunc("/csr-from-key", h.csrFromKeyHandler)
 	h.mux.HandleFunc("/key", h.keyHandler)
 	h.mux.HandleFunc("/cert/", h.certForHostnameHandler)
+	h.mux.HandleFunc("/order/", h.orderHandler)
 	h.mux.HandleFunc("/status", h.statusHandler)
+	h.registerV2()
 
 	auto := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	// a lease that isn't renewed for this long is taken to belong to a server that died, and
+	// can be taken over
+	issuanceLeaseTTL = 2 * time.Minute
+
+	// how often a server waiting on another server's lease checks whether it is done
+	issuanceLeaseWait = 3 * time.Second
+
+	// how long a failed order is kept for the servers that were waiting on it
+	issuanceFailureTTL = 5 * time.Minute
+)
+
+// IssuanceLeases makes sure only one server in the cluster runs an ACME order for a name at a
+// time. Concurrent orders for the same name would overwrite each other's _acme-challenge record
+// and could both fail validation.
+type IssuanceLeases struct {
+	db     *sql.DB
+	holder string // identifies this process in the leases it holds
+}
+
+func NewIssuanceLeases(db *sql.DB) (*IssuanceLeases, error) {
+	holderBytes := make([]byte, 16)
+	_, err := rand.Read(holderBytes)
+	if err != nil {
+		return nil, err
+	}
+	l := &IssuanceLeases{db, hex.EncodeToString(holderBytes)}
+	if err := l.setupDB(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *IssuanceLeases) setupDB() error {
+	_, err := l.db.Exec(`
+		CREATE TABLE IF NOT EXISTS issuance_leases (
+			subject TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS issuance_failures (
+			subject TEXT PRIMARY KEY,
+			error_code TEXT NOT NULL,
+			error TEXT NOT NULL,
+			failed INTEGER NOT NULL
+		);
+	`)
+	return err
+}
+
+// Acquire takes the lease for subject if nobody holds it or the lease has expired. It reports
+// whether we got it.
+func (l *IssuanceLeases) Acquire(subject string) (bool, error) {
+	now := time.Now()
+	res, err := l.db.Exec(
+		`INSERT INTO issuance_leases (subject, holder, expires) VALUES (?, ?, ?)
+		ON CONFLICT (subject) DO UPDATE SET holder = excluded.holder, expires = excluded.expires
+		WHERE issuance_leases.expires < ?`,
+		subject,
+		l.holder,
+		now.Add(issuanceLeaseTTL).Unix(),
+		now.Unix(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire issuance lease: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire issuance lease: %v", err)
+	}
+	return n == 1, nil
+}
+
+// Renew extends a lease we hold. It returns an error if the lease has been taken over.
+func (l *IssuanceLeases) Renew(subject string) error {
+	res, err := l.db.Exec(
+		`UPDATE issuance_leases SET expires = ? WHERE subject = ? AND holder = ?`,
+		time.Now().Add(issuanceLeaseTTL).Unix(),
+		subject,
+		l.holder,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("issuance lease for %s is held by another server", subject)
+	}
+	return nil
+}
+
+// Release gives up a lease we hold, so servers waiting on it can go ahead.
+func (l *IssuanceLeases) Release(subject string) error {
+	_, err := l.db.Exec(
+		`DELETE FROM issuance_leases WHERE subject = ? AND holder = ?`,
+		subject,
+		l.holder,
+	)
+	return err
+}
+
+// RecordFailure keeps the error our order for subject failed with, so servers that were waiting
+// on the lease return it instead of each running an order that fails the same way. Old failures
+// are cleaned up at the same time.
+func (l *IssuanceLeases) RecordFailure(subject string, orderErr error) error {
+	now := time.Now()
+	_, err := l.db.Exec(
+		`DELETE FROM issuance_failures WHERE failed < ?`,
+		now.Add(-issuanceFailureTTL).Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete old issuance failures: %v", err)
+	}
+	_, err = l.db.Exec(
+		`INSERT INTO issuance_failures (subject, error_code, error, failed) VALUES (?, ?, ?, ?)
+		ON CONFLICT (subject) DO UPDATE SET
+			error_code = excluded.error_code, error = excluded.error, failed = excluded.failed`,
+		subject,
+		errorCode(orderErr),
+		orderErr.Error(),
+		now.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record issuance failure: %v", err)
+	}
+	return nil
+}
+
+// Failure returns the error an order for subject failed with since the given time, or nil if
+// there is none.
+func (l *IssuanceLeases) Failure(subject string, since time.Time) (*codedError, error) {
+	var code, msg string
+	err := l.db.QueryRow(
+		`SELECT error_code, error FROM issuance_failures WHERE subject = ? AND failed >= ? AND failed >= ?`,
+		subject,
+		since.Unix(),
+		time.Now().Add(-issuanceFailureTTL).Unix(),
+	).Scan(&code, &msg)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for issuance failures: %v", err)
+	}
+	return &codedError{code, fmt.Errorf("another server failed to issue %s: %s", subject, msg)}, nil
+}
@@ -59,11 +59,17 @@ func main() {
 		panic(fmt.Errorf("failed to create autocert cache: %v", err))
 	}
 
+	orders, err := NewOrderStore(db)
+	if err != nil {
+		panic(fmt.Errorf("failed to create order store: %v", err))
+	}
+
 	h := &HTTPHandler{
 		ACME:       a,
 		DNSBackend: zone,
 		FSHandler:  http.FileServer(http.Dir(wwwDir)),
 		CertCache:  acc,
+		Orders:     orders,
 	}
 	err = h.ListenAndServe()
 	panic(err)
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// an order that is still pending after this long was lost, most likely because the node
+	// working on it restarted. The node gives up on the order after issuanceTimeout, so this has
+	// to be long enough that a live order is never reported abandoned and then finishes.
+	orderTimeout = issuanceTimeout + issuanceLeaseTTL + 5*time.Minute
+
+	// finished orders are deleted after this long
+	orderRetention = 7 * 24 * time.Hour
+
+	// how long clients are asked to wait between polls
+	orderPollInterval = 5 * time.Second
+)
+
+// OrderStore keeps the state of asynchronous certificate orders in the database, so any node
+// can answer a poll for an order another node is working on.
+type OrderStore struct {
+	db *sql.DB
+}
+
+// order is an asynchronous request for a certificate.
+type order struct {
+	ID        string
+	BaseName  string
+	Status    string // "pending", "valid" or "invalid"
+	Cert      []byte // PEM chain once valid
+	FromCache bool
+	ErrorCode string // once invalid
+	Error     string
+	Created   time.Time
+}
+
+func NewOrderStore(db *sql.DB) (*OrderStore, error) {
+	s := &OrderStore{db}
+	if err := s.setupDB(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *OrderStore) setupDB() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS orders (
+			id TEXT PRIMARY KEY,
+			base_name TEXT NOT NULL,
+			status TEXT NOT NULL,
+			cert TEXT NULL,
+			from_cache INTEGER NOT NULL DEFAULT 0,
+			error_code TEXT NULL,
+			error TEXT NULL,
+			created INTEGER NOT NULL
+		);
+	`)
+	return err
+}
+
+// Create adds a pending order for baseName. Old orders are cleaned up at the same time.
+func (s *OrderStore) Create(baseName string) (*order, error) {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return nil, err
+	}
+	o := &order{
+		ID:       hex.EncodeToString(idBytes),
+		BaseName: baseName,
+		Status:   "pending",
+		Created:  time.Now().Truncate(time.Second), // as stored
+	}
+
+	_, err = s.db.Exec(
+		`DELETE FROM orders WHERE created < ?`,
+		time.Now().Add(-orderRetention).Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete old orders: %v", err)
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO orders (id, base_name, status, created) VALUES (?, ?, ?, ?)`,
+		o.ID,
+		o.BaseName,
+		o.Status,
+		o.Created.Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %v", err)
+	}
+	return o, nil
+}
+
+// Finish marks an order valid with the issued chain.
+func (s *OrderStore) Finish(id string, cert []byte, fromCache bool) error {
+	res, err := s.db.Exec(
+		`UPDATE orders SET status = 'valid', cert = ?, from_cache = ?
+		WHERE id = ? AND status = 'pending' AND created >= ?`,
+		cert,
+		fromCache,
+		id,
+		time.Now().Add(-orderTimeout).Unix(),
+	)
+	return checkOrderUpdated(id, res, err)
+}
+
+// Fail marks an order invalid, keeping the error and its code.
+func (s *OrderStore) Fail(id string, orderErr error) error {
+	res, err := s.db.Exec(
+		`UPDATE orders SET status = 'invalid', error_code = ?, error = ?
+		WHERE id = ? AND status = 'pending' AND created >= ?`,
+		errorCode(orderErr),
+		orderErr.Error(),
+		id,
+		time.Now().Add(-orderTimeout).Unix(),
+	)
+	return checkOrderUpdated(id, res, err)
+}
+
+// checkOrderUpdated returns an error if an update to a pending order didn't change it. An order
+// that has already finished, or has been reported abandoned, keeps the result clients saw.
+func checkOrderUpdated(id string, res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("order %s is no longer pending", id)
+	}
+	return nil
+}
+
+// Get returns the order with the given ID, or nil if there is none.
+func (s *OrderStore) Get(id string) (*order, error) {
+	return scanOrder(s.db.QueryRow(
+		`SELECT id, base_name, status, cert, from_cache, error_code, error, created FROM orders WHERE id = ?`,
+		id,
+	))
+}
+
+// Pending returns the newest order for baseName that is still being worked on, or nil if there
+// is none.
+func (s *OrderStore) Pending(baseName string) (*order, error) {
+	return scanOrder(s.db.QueryRow(
+		`SELECT id, base_name, status, cert, from_cache, error_code, error, created FROM orders
+		WHERE base_name = ? AND status = 'pending' AND created >= ?
+		ORDER BY created DESC LIMIT 1`,
+		baseName,
+		time.Now().Add(-orderTimeout).Unix(),
+	))
+}
+
+// scanOrder reads an order from a row selected by Get or Pending, or returns nil if there was no
+// row.
+func scanOrder(row *sql.Row) (*order, error) {
+	o := &order{}
+	var cert, errorCode, errorMsg sql.NullString
+	var created int64
+	err := row.Scan(&o.ID, &o.BaseName, &o.Status, &cert, &o.FromCache, &errorCode, &errorMsg, &created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.Cert = []byte(cert.String)
+	o.ErrorCode = errorCode.String
+	o.Error = errorMsg.String
+	o.Created = time.Unix(created, 0)
+	o.checkAbandoned(time.Now())
+	return o, nil
+}
+
+// checkAbandoned marks an order invalid if it has been pending for longer than orderTimeout.
+// Finish and Fail won't change it after that.
+func (o *order) checkAbandoned(now time.Time) {
+	if o.Status == "pending" && now.Sub(o.Created) > orderTimeout {
+		o.Status = "invalid"
+		o.ErrorCode = "internal_error"
+		o.Error = "order was abandoned, probably because the server working on it restarted"
+	}
+}
+
+// orderResponse is the JSON description of an order.
+type orderResponse struct {
+	ID string `json:"id"`
+	hostnameResponse
+	Status      string        `json:"status"` // "pending", "valid" or "invalid"
+	Created     time.Time     `json:"created"`
+	Error       *errorDetail  `json:"error,omitempty"`
+	Certificate *certResponse `json:"certificate,omitempty"`
+}
+
+func (o *order) response() (*orderResponse, error) {
+	r := &orderResponse{
+		ID:               o.ID,
+		hostnameResponse: newHostnameResponse(o.BaseName),
+		Status:           o.Status,
+		Created:          o.Created,
+	}
+	switch o.Status {
+	case "valid":
+		cert, err := newCertResponse(o.BaseName, o.Cert, o.FromCache)
+		if err != nil {
+			return nil, err
+		}
+		r.Certificate = cert
+	case "invalid":
+		r.Error = &errorDetail{o.ErrorCode, o.Error}
+	}
+	return r, nil
+}
+
+// startOrder creates an order for baseName and requests the certificate in the background. It
+// responds with 202 Accepted and the order's location. If there is already a pending order for
+// baseName, that order is returned instead of starting another one.
+func (h *HTTPHandler) startOrder(resp http.ResponseWriter, baseName string, csr []byte) {
+	o, err := h.Orders.Pending(baseName)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to look up pending orders: %v", err)
+		http.Error(resp, errMsg, http.StatusInternalServerError)
+		return
+	}
+	if o != nil {
+		writeOrderAccepted(resp, o)
+		return
+	}
+
+	o, err = h.Orders.Create(baseName)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to create order: %v", err)
+		http.Error(resp, errMsg, http.StatusInternalServerError)
+		return
+	}
+
+	go func() {
+		// the request that started the order is already over
+		ctx, cancel := context.WithTimeout(context.Background(), issuanceTimeout)
+		defer cancel()
+
+		cert, fromCache, err := h.ACME.RequestCert(ctx, baseName, csr, h.DNSBackend)
+		if err != nil {
+			log.Printf("Order %s for %s failed: %v", o.ID, baseName, err)
+			err = h.Orders.Fail(o.ID, err)
+		} else {
+			err = h.Orders.Finish(o.ID, cert, fromCache)
+		}
+		if err != nil {
+			log.Printf("Failed to update order %s: %v", o.ID, err)
+		}
+	}()
+
+	writeOrderAccepted(resp, o)
+}
+
+// writeOrderAccepted responds with 202 Accepted, the pending order o and where to poll it.
+func writeOrderAccepted(resp http.ResponseWriter, o *order) {
+	r, err := o.response()
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to describe order: %v", err)
+		http.Error(resp, errMsg, http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Location", "/order/"+o.ID)
+	resp.Header().Set("Retry-After", fmt.Sprint(int(orderPollInterval.Seconds())))
+	writeV2JSON(resp, http.StatusAccepted, r)
+}
+
+// orderHandler reports the state of an order as JSON. Once the order is valid, ?format= returns
+// the certificate itself in that format instead.
+func (h *HTTPHandler) orderHandler(resp http.ResponseWriter, req *http.Request) {
+	if !checkMethod(resp, req, http.MethodGet, http.MethodHead) {
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/order/")
+
+	o, err := h.Orders.Get(id)
+	if err != nil {
+		writeV2Error(resp, fmt.Errorf("failed to get order: %v", err))
+		return
+	}
+	if o == nil {
+		writeV2Error(resp, &codedError{"not_found", fmt.Errorf("no order %s", id)})
+		return
+	}
+
+	if o.Status == "valid" && req.URL.Query().Get("format") != "" {
+		format, err := negotiateCertFormat(req)
+		if err != nil {
+			writeV2Error(resp, &codedError{"invalid_request", err})
+			return
+		}
+		writeCert(resp, format, o.BaseName, o.BaseName, o.Cert, o.FromCache)
+		return
+	}
+
+	r, err := o.response()
+	if err != nil {
+		writeV2Error(resp, err)
+		return
+	}
+	if o.Status == "pending" {
+		resp.Header().Set("Retry-After", fmt.Sprint(int(orderPollInterval.Seconds())))
+	}
+	writeV2JSON(resp, http.StatusOK, r)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOrderTimeout(t *testing.T) {
+	// a node can wait out another node's lease and then run its own order, all within
+	// issuanceTimeout, before it records the result
+	if orderTimeout <= issuanceTimeout+issuanceLeaseTTL {
+		t.Errorf("orderTimeout (%s) is not longer than issuanceTimeout (%s) and a lease (%s)", orderTimeout, issuanceTimeout, issuanceLeaseTTL)
+	}
+}
+
+func TestCheckAbandoned(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	tests := []struct {
+		status     string
+		now        time.Time
+		wantStatus string
+	}{
+		{"pending", created.Add(issuanceTimeout), "pending"},
+		{"pending", created.Add(orderTimeout), "pending"},
+		{"pending", created.Add(orderTimeout + time.Second), "invalid"},
+		{"valid", created.Add(orderRetention), "valid"},
+		{"invalid", created.Add(orderRetention), "invalid"},
+	}
+	for _, tt := range tests {
+		o := &order{Status: tt.status, Created: created}
+		o.checkAbandoned(tt.now)
+		if o.Status != tt.wantStatus {
+			t.Errorf("%s order after %s: status %s, want %s", tt.status, tt.now.Sub(created), o.Status, tt.wantStatus)
+		}
+		if o.Status == "invalid" && tt.status == "pending" && o.ErrorCode != "internal_error" {
+			t.Errorf("abandoned order error code = %q, want internal_error", o.ErrorCode)
+		}
+	}
+}
+
+func TestOrderResponse(t *testing.T) {
+	const baseName = "9b7d8f4b4f45183149c1b666d08d1f8c.bfcd0704a087908e509c39b1c2b98cc5.tls.page"
+	chainPEM, _ := testChain(t, baseName)
+	created := time.Now().Truncate(time.Second)
+
+	valid := &order{ID: "a1", BaseName: baseName, Status: "valid", Cert: chainPEM, FromCache: true, Created: created}
+	r, err := valid.response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != "a1" || r.BaseName != baseName || r.Certificate == nil || !r.Certificate.FromCache || r.Error != nil {
+		t.Errorf("valid order response = %+v", r)
+	}
+
+	invalid := &order{ID: "a2", BaseName: baseName, Status: "invalid", ErrorCode: "acme_rate_limited", Error: "too many certificates", Created: created}
+	r, err = invalid.response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Certificate != nil || r.Error == nil || r.Error.Code != "acme_rate_limited" {
+		t.Errorf("invalid order response = %+v", r)
+	}
+
+	pending := &order{ID: "a3", BaseName: baseName, Status: "pending", Created: created}
+	rec := httptest.NewRecorder()
+	writeOrderAccepted(rec, pending)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Location") != "/order/a3" || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("accepted order: status %d, Location %q, Retry-After %q", rec.Code, rec.Header().Get("Location"), rec.Header().Get("Retry-After"))
+	}
+	var body orderResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.ID != "a3" || body.Status != "pending" || body.Certificate != nil || body.Error != nil || !body.Created.Equal(created) {
+		t.Errorf("accepted order body = %+v", body)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/9072997/tlspage"
+)
+
+// The /v2/ API takes the same request bodies as v1 and always responds with JSON. Failures are
+// {"error": {"code": ..., "message": ...}} with a code from errorStatuses.
+
+// hostnameResponse is the /v2/ description of a key-pinned base name.
+type hostnameResponse struct {
+	BaseName string `json:"base_name"`
+	SAN      string `json:"san"` // the wildcard name certificates are issued for
+}
+
+type certResponse struct {
+	hostnameResponse
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Serial    string    `json:"serial"` // hex
+	Issuer    string    `json:"issuer"`
+	Chain     []string  `json:"chain"` // PEM, leaf first
+	FromCache bool      `json:"from_cache"`
+}
+
+type csrResponse struct {
+	hostnameResponse
+	CSR string `json:"csr"` // PEM
+}
+
+type keyResponse struct {
+	hostnameResponse
+	KeyType string `json:"key_type"`
+	Key     string `json:"key"` // PEM
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+func (h *HTTPHandler) registerV2() {
+	h.mux.HandleFunc("/v2/", v2Index)
+	h.mux.HandleFunc("/v2/hostname-from-cert", v2Handler(http.MethodPost, h.v2HostnameFromCert))
+	h.mux.HandleFunc("/v2/hostname-from-csr", v2Handler(http.MethodPost, h.v2HostnameFromCSR))
+	h.mux.HandleFunc("/v2/hostname-from-key", v2Handler(http.MethodPost, h.v2HostnameFromKey))
+	h.mux.HandleFunc("/v2/cert-from-csr", v2Handler(http.MethodPost, h.v2CertFromCSR))
+	h.mux.HandleFunc("/v2/cert-from-key", v2Handler(http.MethodPost, h.v2CertFromKey))
+	h.mux.HandleFunc("/v2/csr-from-key", v2Handler(http.MethodPost, h.v2CSRFromKey))
+	h.mux.HandleFunc("/v2/key", v2Handler(http.MethodGet, h.v2Key))
+	h.mux.HandleFunc("/v2/cert/", v2Handler(http.MethodGet, h.v2CertForHostname))
+	h.mux.HandleFunc("/v2/status", v2Handler(http.MethodGet, h.v2Status))
+}
+
+// v2Handler adapts fn to only accept method (and HEAD for GET, and OPTIONS for CORS preflight
+// requests), and to write its result or error as JSON.
+func v2Handler(method string, fn func(http.ResponseWriter, *http.Request) (any, error)) http.HandlerFunc {
+	methods := []string{method}
+	if method == http.MethodGet {
+		methods = append(methods, http.MethodHead)
+	}
+
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !slices.Contains(methods, req.Method) {
+			resp.Header().Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+			if req.Method == http.MethodOptions {
+				resp.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeV2Error(resp, &codedError{"method_not_allowed", fmt.Errorf("method %s not allowed", req.Method)})
+			return
+		}
+
+		result, err := fn(resp, req)
+		if err != nil {
+			writeV2Error(resp, err)
+			return
+		}
+		writeV2JSON(resp, http.StatusOK, result)
+	}
+}
+
+// v2Index serves the API documentation at /v2/ and a not_found error for anything else under
+// /v2/.
+func v2Index(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v2/" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		serveAPIDocs(resp, "v2", "request-body")
+		return
+	}
+	writeV2Error(resp, &codedError{"not_found", fmt.Errorf("no such endpoint %s", req.URL.Path)})
+}
+
+func writeV2JSON(resp http.ResponseWriter, status int, v any) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	enc := json.NewEncoder(resp)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func writeV2Error(resp http.ResponseWriter, err error) {
+	body := errorResponse{errorDetail{errorCode(err), err.Error()}}
+	writeV2JSON(resp, errorStatus(err), body)
+}
+
+func newHostnameResponse(baseName string) hostnameResponse {
+	return hostnameResponse{BaseName: baseName, SAN: "*." + baseName}
+}
+
+// newCertResponse describes a PEM certificate chain, leaf first.
+func newCertResponse(baseName string, chainPEM []byte, fromCache bool) (*certResponse, error) {
+	r := &certResponse{hostnameResponse: newHostnameResponse(baseName), FromCache: fromCache}
+	var leaf *x509.Certificate
+	rest := chainPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		r.Chain = append(r.Chain, string(pem.EncodeToMemory(block)))
+		if leaf == nil {
+			var err error
+			leaf, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse issued certificate: %v", err)
+			}
+		}
+	}
+	if leaf == nil {
+		return nil, fmt.Errorf("no certificate in issued chain")
+	}
+
+	r.NotBefore = leaf.NotBefore
+	r.NotAfter = leaf.NotAfter
+	r.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+	r.Issuer = leaf.Issuer.String()
+	return r, nil
+}
+
+func (h *HTTPHandler) v2HostnameFromCert(resp http.ResponseWriter, req *http.Request) (any, error) {
+	block, err := readBody(resp, req, certBody)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, &codedError{"invalid_certificate", fmt.Errorf("failed to parse certificate: %v", err)}
+	}
+	hostname, err := tlspage.HostnameFromCertificate(cert, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, &codedError{"invalid_certificate", fmt.Errorf("certificate is not key-pinned: %v", err)}
+	}
+	return newHostnameResponse(hostname), nil
+}
+
+func (h *HTTPHandler) v2HostnameFromCSR(resp http.ResponseWriter, req *http.Request) (any, error) {
+	block, err := readBody(resp, req, csrBody)
+	if err != nil {
+		return nil, err
+	}
+	baseName, err := CSRPinnedBaseName(block.Bytes, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, err
+	}
+	err = h.ACME.cache.PutCSR(block.Bytes, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache CSR: %v", err)
+	}
+	return newHostnameResponse(baseName), nil
+}
+
+func (h *HTTPHandler) v2HostnameFromKey(resp http.ResponseWriter, req *http.Request) (any, error) {
+	block, err := readBody(resp, req, keyBody)
+	if err != nil {
+		return nil, err
+	}
+	baseName, csr, err := KeyPinnedCSR(string(pem.EncodeToMemory(block)), h.DNSBackend.Origin)
+	if err != nil {
+		return nil, err
+	}
+	err = h.ACME.cache.PutCSR(csr, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache CSR: %v", err)
+	}
+	return newHostnameResponse(baseName), nil
+}
+
+func (h *HTTPHandler) v2CertFromCSR(resp http.ResponseWriter, req *http.Request) (any, error) {
+	block, err := readBody(resp, req, csrBody)
+	if err != nil {
+		return nil, err
+	}
+	baseName, err := CSRPinnedBaseName(block.Bytes, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, err
+	}
+	cert, fromCache, err := h.ACME.RequestCert(req.Context(), baseName, block.Bytes, h.DNSBackend)
+	if err != nil {
+		return nil, err
+	}
+	return newCertResponse(baseName, cert, fromCache)
+}
+
+func (h *HTTPHandler) v2CertFromKey(resp http.ResponseWriter, req *http.Request) (any, error) {
+	block, err := readBody(resp, req, keyBody)
+	if err != nil {
+		return nil, err
+	}
+	baseName, csr, err := KeyPinnedCSR(string(pem.EncodeToMemory(block)), h.DNSBackend.Origin)
+	if err != nil {
+		return nil, err
+	}
+	cert, fromCache, err := h.ACME.RequestCert(req.Context(), baseName, csr, h.DNSBackend)
+	if err != nil {
+		return nil, err
+	}
+	return newCertResponse(baseName, cert, fromCache)
+}
+
+func (h *HTTPHandler) v2CSRFromKey(resp http.ResponseWriter, req *http.Request) (any, error) {
+	block, err := readBody(resp, req, keyBody)
+	if err != nil {
+		return nil, err
+	}
+	baseName, csr, err := KeyPinnedCSR(string(pem.EncodeToMemory(block)), h.DNSBackend.Origin)
+	if err != nil {
+		return nil, err
+	}
+	err = h.ACME.cache.PutCSR(csr, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache CSR: %v", err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	return &csrResponse{newHostnameResponse(baseName), string(csrPEM)}, nil
+}
+
+func (h *HTTPHandler) v2Key(resp http.ResponseWriter, req *http.Request) (any, error) {
+	keyType, err := requestedKeyType(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := tlspage.GenerateKeyWithType(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	baseName, csr, err := KeyPinnedCSR(key, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, err
+	}
+	err = h.ACME.cache.PutCSR(csr, h.DNSBackend.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache CSR: %v", err)
+	}
+	return &keyResponse{newHostnameResponse(baseName), string(keyType), key}, nil
+}
+
+func (h *HTTPHandler) v2CertForHostname(resp http.ResponseWriter, req *http.Request) (any, error) {
+	hostname := strings.TrimPrefix(req.URL.Path, "/v2/cert/")
+
+	csr, _, _, err := h.ACME.cache.Get("*." + hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CSR from cache: %v", err)
+	}
+	if csr == nil {
+		return nil, &codedError{"not_found", fmt.Errorf("no CSR for %s; submit one to /v2/hostname-from-csr first", hostname)}
+	}
+
+	cert, fromCache, err := h.ACME.RequestCert(req.Context(), hostname, csr, h.DNSBackend)
+	if err != nil {
+		return nil, err
+	}
+	return newCertResponse(hostname, cert, fromCache)
+}
+
+func (h *HTTPHandler) v2Status(resp http.ResponseWriter, req *http.Request) (any, error) {
+	err := h.checkHealth()
+	if err != nil {
+		return nil, &codedError{"unhealthy", err}
+	}
+	return &statusResponse{"ok"}, nil
+}
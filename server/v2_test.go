@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9072997/tlspage"
+	"golang.org/x/crypto/acme"
+)
+
+// newV2Server serves the /v2/ API for origin tls.page. Only requests that fail before the cache
+// is used can be made, since there is no database.
+func newV2Server(t *testing.T) *httptest.Server {
+	t.Helper()
+	h := &HTTPHandler{DNSBackend: DNSBackend{Origin: "tls.page"}, mux: http.NewServeMux()}
+	h.registerV2()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testCert returns a self-signed PEM certificate for a new key, and the base name the key pins
+// under origin. The certificate is for the name returned by dnsName, given that base name.
+func testCert(t *testing.T, origin string, dnsName func(baseName string) string) (string, string) {
+	t.Helper()
+	keyPEM, err := tlspage.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := tlspage.ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseName, err := tlspage.Hostname(keyPEM, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := dnsName(baseName)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), baseName
+}
+
+// testCSRForKey returns a PEM CSR for a new key of keyType, pinned under origin.
+func testCSRForKey(t *testing.T, keyType tlspage.KeyType, origin string) string {
+	t.Helper()
+	keyPEM, err := tlspage.GenerateKeyWithType(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, err := tlspage.Hostname(keyPEM, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM, err := tlspage.GenerateCSR(keyPEM, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csrPEM
+}
+
+func TestV2ErrorCodes(t *testing.T) {
+	srv := newV2Server(t)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+	}{
+		{"unknown endpoint", http.MethodGet, "/v2/nope", "", "", http.StatusNotFound, "not_found"},
+		{"wrong method", http.MethodGet, "/v2/hostname-from-cert", "", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"POST to GET endpoint", http.MethodPost, "/v2/key", "", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"unsupported media type", http.MethodPost, "/v2/hostname-from-cert", "image/png", "x", http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"too large", http.MethodPost, "/v2/hostname-from-csr", "", strings.Repeat("A", int(csrBody.MaxBytes)+1), http.StatusRequestEntityTooLarge, "request_too_large"},
+		{"empty body", http.MethodPost, "/v2/hostname-from-key", "", "", http.StatusBadRequest, "invalid_request"},
+		{"bad certificate", http.MethodPost, "/v2/hostname-from-cert", "application/octet-stream", "not DER", http.StatusBadRequest, "invalid_certificate"},
+		{"bad CSR", http.MethodPost, "/v2/hostname-from-csr", "application/octet-stream", "not DER", http.StatusBadRequest, "invalid_csr"},
+		{"CSR for another origin", http.MethodPost, "/v2/hostname-from-csr", "", testCSRForKey(t, tlspage.KeyTypeECDSAP256, "example.com"), http.StatusBadRequest, "csr_name_mismatch"},
+		{"CSR key type not allowed", http.MethodPost, "/v2/cert-from-csr", "", testCSRForKey(t, tlspage.KeyTypeEd25519, "tls.page"), http.StatusBadRequest, "key_type_not_allowed"},
+		{"bad key", http.MethodPost, "/v2/csr-from-key", "application/octet-stream", "not DER", http.StatusBadRequest, "invalid_key"},
+		{"unknown key type", http.MethodGet, "/v2/key?type=dsa", "", "", http.StatusBadRequest, "invalid_request"},
+		{"key type not allowed", http.MethodGet, "/v2/key?type=ed25519", "", "", http.StatusBadRequest, "key_type_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var body errorResponse
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			if err != nil {
+				t.Fatalf("error body is not JSON: %v", err)
+			}
+			if body.Error.Code != tt.wantCode || body.Error.Message == "" {
+				t.Errorf("error = %+v, want code %s with a message", body.Error, tt.wantCode)
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed && resp.Header.Get("Allow") == "" {
+				t.Errorf("405 without an Allow header")
+			}
+		})
+	}
+}
+
+func TestV2HostnameFromCert(t *testing.T) {
+	srv := newV2Server(t)
+	wildcard := func(baseName string) string { return "*." + baseName }
+
+	// certificates that aren't key-pinned under the server's origin are rejected
+	tests := []struct {
+		name    string
+		origin  string
+		dnsName func(baseName string) string
+	}{
+		{"other origin", "example.com", wildcard},
+		{"not the wildcard", "tls.page", func(baseName string) string { return "www." + baseName }},
+		{"another key's name", "tls.page", func(string) string {
+			return "*.9b7d8f4b4f45183149c1b666d08d1f8c.bfcd0704a087908e509c39b1c2b98cc5.tls.page"
+		}},
+	}
+	for _, tt := range tests {
+		certPEM, _ := testCert(t, tt.origin, tt.dnsName)
+		resp, err := srv.Client().Post(srv.URL+"/v2/hostname-from-cert", "application/x-pem-file", strings.NewReader(certPEM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body errorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusBadRequest || body.Error.Code != "invalid_certificate" {
+			t.Errorf("%s: status %d, error %+v (%v), want 400 invalid_certificate", tt.name, resp.StatusCode, body.Error, err)
+		}
+	}
+
+	certPEM, baseName := testCert(t, "tls.page", wildcard)
+	resp, err := srv.Client().Post(srv.URL+"/v2/hostname-from-cert", "application/x-pem-file", strings.NewReader(certPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var body hostnameResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.BaseName != baseName || body.SAN != "*."+baseName {
+		t.Errorf("response = %+v, want base name %s", body, baseName)
+	}
+
+	// CORS preflight
+	req, err := http.NewRequest(http.MethodOptions, srv.URL+"/v2/hostname-from-cert", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("OPTIONS status = %d, CORS origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestV2HandlerErrors(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{errors.New("database is locked"), http.StatusInternalServerError, "internal_error"},
+		{&codedError{"not_found", errors.New("no CSR")}, http.StatusNotFound, "not_found"},
+		{fmt.Errorf("requesting certificate: %w", &codedError{"unhealthy", errors.New("no quorum")}), http.StatusServiceUnavailable, "unhealthy"},
+		{acmeFailure("failed to authorize order", &acme.Error{StatusCode: 429, ProblemType: "urn:ietf:params:acme:error:rateLimited"}), http.StatusTooManyRequests, "acme_rate_limited"},
+		{acmeFailure("failed to authorize order", &acme.Error{StatusCode: 400, ProblemType: "urn:ietf:params:acme:error:malformed"}), http.StatusBadGateway, "acme_error"},
+	}
+	for _, tt := range tests {
+		handler := v2Handler(http.MethodGet, func(http.ResponseWriter, *http.Request) (any, error) {
+			return nil, tt.err
+		})
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/v2/test", nil))
+
+		var body errorResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.wantStatus || body.Error.Code != tt.wantCode {
+			t.Errorf("%v: status %d, code %s, want %d, %s", tt.err, rec.Code, body.Error.Code, tt.wantStatus, tt.wantCode)
+		}
+	}
+
+	// every code has a status
+	for code, status := range errorStatuses {
+		if status < 400 {
+			t.Errorf("errorStatuses[%s] = %d", code, status)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+// Package tlspagetest provides a fake tls.page server for testing code that uses the tlspage
+// package without network access. Certificates are signed by an in-memory test CA.
+//
+//	srv := tlspagetest.NewServer("")
+//	defer srv.Close()
+//	m := &tlspage.Manager{Client: srv.Client()}
+package tlspagetest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9072997/tlspage"
+)
+
+// Server is a fake tls.page server. It implements /cert-from-csr, /cert/{hostname},
+// /hostname-from-csr, /hostname-from-key, /hostname-from-cert and /status, and validates CSRs
+// the same way the real server does.
+type Server struct {
+	// URL is the base URL of the server, for use as tlspage.Client.BaseURL.
+	URL string
+
+	// Origin is the origin key-pinned hostnames must be under.
+	Origin string
+
+	// Roots contains the test CA's root certificate. Issued chains verify against it.
+	Roots *x509.CertPool
+
+	// Root is the test CA's root certificate.
+	Root *x509.Certificate
+
+	srv          *httptest.Server
+	rootKey      crypto.Signer
+	intermediate *x509.Certificate
+	interKey     crypto.Signer
+
+	mu              sync.Mutex
+	csrs            map[string][]byte // DER CSRs by base name
+	allowedKeyTypes []tlspage.KeyType
+	lifetime        time.Duration
+	delay           time.Duration
+	failures        []int
+	wrongKey        int
+	requests        int
+	serial          int64
+}
+
+// NewServer starts a fake server for origin. If origin is empty, "tls.page" is used.
+// The caller should call Close when finished.
+func NewServer(origin string) *Server {
+	if origin == "" {
+		origin = "tls.page"
+	}
+	s := &Server{
+		Origin:          origin,
+		csrs:            make(map[string][]byte),
+		allowedKeyTypes: slices.Clone(tlspage.KeyTypes),
+		lifetime:        90 * 24 * time.Hour,
+	}
+
+	var err error
+	s.Root, s.rootKey, err = newCA("tlspagetest Root", nil, nil)
+	if err != nil {
+		panic(fmt.Sprintf("tlspagetest: failed to create root CA: %v", err))
+	}
+	s.intermediate, s.interKey, err = newCA("tlspagetest Intermediate", s.Root, s.rootKey)
+	if err != nil {
+		panic(fmt.Sprintf("tlspagetest: failed to create intermediate CA: %v", err))
+	}
+	s.Roots = x509.NewCertPool()
+	s.Roots.AddCert(s.Root)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cert-from-csr", s.certFromCSRHandler)
+	mux.HandleFunc("/cert/", s.certForHostnameHandler)
+	mux.HandleFunc("/hostname-from-csr", s.hostnameFromCSRHandler)
+	mux.HandleFunc("/hostname-from-key", s.hostnameFromKeyHandler)
+	mux.HandleFunc("/hostname-from-cert", s.hostnameFromCertHandler)
+	mux.HandleFunc("/status", s.statusHandler)
+	s.srv = httptest.NewServer(s.inject(mux))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns a tlspage.Client for the server. It retries quickly so tests don't wait.
+func (s *Server) Client() *tlspage.Client {
+	return &tlspage.Client{
+		HTTPClient:    s.srv.Client(),
+		BaseURL:       s.URL,
+		Retries:       3,
+		RetryDelay:    10 * time.Millisecond,
+		MaxRetryDelay: 100 * time.Millisecond,
+	}
+}
+
+// SetAllowedKeyTypes limits the key types the server accepts, like the allowed_key_types server
+// setting. By default every type in tlspage.KeyTypes is accepted.
+func (s *Server) SetAllowedKeyTypes(keyTypes ...tlspage.KeyType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allowedKeyTypes = keyTypes
+}
+
+// SetLifetime sets the validity period of certificates issued from now on. The default is
+// 90 days.
+func (s *Server) SetLifetime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetime = d
+}
+
+// SetDelay makes every response wait d before it is written. The wait ends early if the
+// client goes away.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// FailNext makes the next n requests fail with the given HTTP status code.
+func (s *Server) FailNext(n int, statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range n {
+		s.failures = append(s.failures, statusCode)
+	}
+}
+
+// IssueWrongKey makes the next n certificates contain a freshly generated public key instead
+// of the one from the CSR, as a buggy or compromised server might.
+func (s *Server) IssueWrongKey(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wrongKey += n
+}
+
+// Requests returns the number of requests the server has received, including failed ones.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// inject wraps next with the delays and failures set up by SetDelay and FailNext.
+func (s *Server) inject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		delay := s.delay
+		status := 0
+		if len(s.failures) > 0 {
+			status = s.failures[0]
+			s.failures = s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if status != 0 {
+			http.Error(resp, "tlspagetest: injected failure", status)
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+func (s *Server) certFromCSRHandler(resp http.ResponseWriter, req *http.Request) {
+	csr, ok := readCSR(resp, req)
+	if !ok {
+		return
+	}
+	baseName, err := s.validateCSR(csr)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("CSR validation failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	s.storeCSR(baseName, csr)
+	s.writeCert(resp, csr)
+}
+
+func (s *Server) certForHostnameHandler(resp http.ResponseWriter, req *http.Request) {
+	hostname := strings.ToLower(req.URL.Path[len("/cert/"):])
+
+	s.mu.Lock()
+	csr := s.csrs[hostname]
+	s.mu.Unlock()
+	if csr == nil {
+		http.Error(resp, "CSR not found in cache", http.StatusNotFound)
+		return
+	}
+	s.writeCert(resp, csr)
+}
+
+func (s *Server) hostnameFromCSRHandler(resp http.ResponseWriter, req *http.Request) {
+	csr, ok := readCSR(resp, req)
+	if !ok {
+		return
+	}
+	baseName, err := s.validateCSR(csr)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("CSR validation failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	s.storeCSR(baseName, csr)
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(baseName))
+}
+
+func (s *Server) hostnameFromKeyHandler(resp http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(resp, req)
+	if !ok {
+		return
+	}
+	hostname, err := tlspage.Hostname(string(body), s.Origin)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Failed to extract hostname: %v", err), http.StatusBadRequest)
+		return
+	}
+	csrPEM, err := tlspage.GenerateCSR(string(body), hostname)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Failed to extract hostname: %v", err), http.StatusBadRequest)
+		return
+	}
+	block, _ := pem.Decode([]byte(csrPEM))
+	baseName, err := s.validateCSR(block.Bytes)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Failed to extract hostname: %v", err), http.StatusBadRequest)
+		return
+	}
+	s.storeCSR(baseName, block.Bytes)
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(baseName))
+}
+
+func (s *Server) hostnameFromCertHandler(resp http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(resp, req)
+	if !ok {
+		return
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		http.Error(resp, "Failed to decode PEM certificate", http.StatusBadRequest)
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Failed to parse certificate: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	hostname, err := tlspage.HostnameFromCertificate(cert, s.Origin)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Certificate is not key-pinned: %v", err), http.StatusBadRequest)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(hostname))
+}
+
+func (s *Server) statusHandler(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte("OK\n"))
+}
+
+// validateCSR performs the same checks as the real server's CSRPinnedBaseName, plus the
+// signature check the CA would do.
+func (s *Server) validateCSR(csrDER []byte) (string, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse CSR: %v", err)
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return "", fmt.Errorf("invalid CSR signature: %v", err)
+	}
+
+	keyType, err := tlspage.KeyTypeOf(csr.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	allowed := s.allowedKeyTypes
+	s.mu.Unlock()
+	if !slices.Contains(allowed, keyType) {
+		return "", fmt.Errorf(
+			"key type %s is not accepted by the configured CA (allowed: %v)",
+			keyType,
+			allowed,
+		)
+	}
+
+	return tlspage.HostnameFromCSR(csr, s.Origin)
+}
+
+func (s *Server) storeCSR(baseName string, csr []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.csrs[baseName] = csr
+}
+
+// writeCert issues a certificate for an already validated CSR and writes the PEM chain.
+func (s *Server) writeCert(resp http.ResponseWriter, csrDER []byte) {
+	chain, err := s.issue(csrDER)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Failed to get certificate: %v", err), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	resp.Header().Set("Content-Disposition", "attachment; filename=\"cert.pem\"")
+	resp.Write(chain)
+}
+
+// issue signs a leaf for the CSR with the intermediate and returns the leaf and intermediate
+// as PEM, like an ACME CA would.
+func (s *Server) issue(csrDER []byte) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.serial++
+	serial := s.serial
+	lifetime := s.lifetime
+	wrongKey := s.wrongKey > 0
+	if wrongKey {
+		s.wrongKey--
+	}
+	s.mu.Unlock()
+
+	pub := csr.PublicKey
+	if wrongKey {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		pub = otherKey.Public()
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.intermediate, pub, s.interKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain bytes.Buffer
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: s.intermediate.Raw})
+	return chain.Bytes(), nil
+}
+
+// newCA creates a CA certificate. If parent is nil the certificate is self-signed.
+func newCA(name string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// readBody reads a request body of up to 10KB, writing an error response if that fails.
+func readBody(resp http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, 10*1024))
+	if err != nil {
+		http.Error(resp, "Request too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return body, true
+}
+
+// readCSR reads a PEM or DER CSR from the request body.
+func readCSR(resp http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, ok := readBody(resp, req)
+	if !ok {
+		return nil, false
+	}
+	if !bytes.Contains(body, []byte("----")) {
+		return body, true
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		http.Error(resp, "Failed to decode PEM CSR", http.StatusBadRequest)
+		return nil, false
+	}
+	return block.Bytes, true
+}
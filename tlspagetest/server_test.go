@@ -0,0 +1,184 @@
+package tlspagetest
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9072997/tlspage"
+)
+
+func newCSR(t *testing.T, origin string) (privKeyPEM, hostname, csrPEM string) {
+	t.Helper()
+	privKeyPEM, err := tlspage.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, err = tlspage.Hostname(privKeyPEM, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM, err = tlspage.GenerateCSR(privKeyPEM, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privKeyPEM, hostname, csrPEM
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer("")
+	defer srv.Close()
+	c := srv.Client()
+	ctx := context.Background()
+
+	_, hostname, csrPEM := newCSR(t, srv.Origin)
+	certPEMs, err := c.CertFromCSR(ctx, csrPEM)
+	if err != nil {
+		t.Fatalf("CertFromCSR() error = %v", err)
+	}
+
+	block, _ := pem.Decode([]byte(certPEMs[0]))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, certPEM := range certPEMs[1:] {
+		intermediates.AppendCertsFromPEM([]byte(certPEM))
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       "www." + hostname,
+		Roots:         srv.Roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Errorf("issued certificate does not verify against Roots: %v", err)
+	}
+
+	_, err = c.CertForHostname(ctx, hostname)
+	if err != nil {
+		t.Errorf("CertForHostname() error = %v", err)
+	}
+	got, err := c.HostnameFromCSR(ctx, csrPEM)
+	if err != nil || got != hostname {
+		t.Errorf("HostnameFromCSR() = %v, %v, want %v", got, err, hostname)
+	}
+	got, err = c.HostnameFromCert(ctx, certPEMs[0])
+	if err != nil || got != hostname {
+		t.Errorf("HostnameFromCert() = %v, %v, want %v", got, err, hostname)
+	}
+	// the CA certificate isn't key-pinned
+	_, err = c.HostnameFromCert(ctx, certPEMs[len(certPEMs)-1])
+	if err == nil {
+		t.Errorf("HostnameFromCert() for the CA certificate error = nil, want an error")
+	}
+	err = c.Status(ctx)
+	if err != nil {
+		t.Errorf("Status() error = %v", err)
+	}
+
+	// a CSR the server has never seen
+	_, otherHostname, _ := newCSR(t, srv.Origin)
+	_, err = c.CertForHostname(ctx, otherHostname)
+	var serverErr *tlspage.ServerError
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusNotFound {
+		t.Errorf("CertForHostname() for unknown hostname error = %v, want 404", err)
+	}
+
+	// key types the CA doesn't issue for
+	srv.SetAllowedKeyTypes(tlspage.KeyTypeRSA2048)
+	_, err = c.CertFromCSR(ctx, csrPEM)
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("CertFromCSR() with disallowed key type error = %v, want 400", err)
+	}
+}
+
+func TestServerFailures(t *testing.T) {
+	srv := NewServer("example.com")
+	defer srv.Close()
+	c := srv.Client()
+	ctx := context.Background()
+	_, _, csrPEM := newCSR(t, srv.Origin)
+
+	t.Run("transient", func(t *testing.T) {
+		before := srv.Requests()
+		srv.FailNext(2, http.StatusServiceUnavailable)
+		_, err := c.CertFromCSR(ctx, csrPEM)
+		if err != nil {
+			t.Errorf("CertFromCSR() error = %v", err)
+		}
+		if n := srv.Requests() - before; n != 3 {
+			t.Errorf("CertFromCSR() made %d requests, want 3", n)
+		}
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		srv.FailNext(1, http.StatusInternalServerError)
+		_, err := c.CertFromCSR(ctx, csrPEM)
+		var serverErr *tlspage.ServerError
+		if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusInternalServerError {
+			t.Errorf("CertFromCSR() error = %v, want 500", err)
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		srv.IssueWrongKey(1)
+		_, err := c.CertFromCSR(ctx, csrPEM)
+		if err == nil || !strings.Contains(err.Error(), "invalid certificate") {
+			t.Errorf("CertFromCSR() error = %v, want invalid certificate", err)
+		}
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		srv.SetDelay(time.Second)
+		defer srv.SetDelay(0)
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := c.CertFromCSR(ctx, csrPEM)
+		if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+			t.Errorf("CertFromCSR() error = %v, want deadline exceeded", err)
+		}
+	})
+}
+
+func TestManager(t *testing.T) {
+	srv := NewServer("")
+	defer srv.Close()
+	cache := tlspage.NewMemCache()
+	ctx := context.Background()
+
+	m := &tlspage.Manager{Cache: cache, Client: srv.Client()}
+	defer m.Close()
+	cert, err := m.Certificate(ctx)
+	if err != nil {
+		t.Fatalf("Certificate() error = %v", err)
+	}
+	hostname, err := m.Hostname(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cert.Leaf.VerifyHostname("www." + hostname)
+	if err != nil {
+		t.Errorf("certificate is not for %s: %v", hostname, err)
+	}
+
+	// a second manager with the same cache should not need the server
+	before := srv.Requests()
+	m2 := &tlspage.Manager{Cache: cache, Client: srv.Client()}
+	defer m2.Close()
+	cert2, err := m2.Certificate(ctx)
+	if err != nil {
+		t.Fatalf("Certificate() from cache error = %v", err)
+	}
+	if !cert2.Leaf.Equal(cert.Leaf) {
+		t.Errorf("Certificate() from cache returned a different certificate")
+	}
+	if srv.Requests() != before {
+		t.Errorf("Certificate() from cache made %d requests", srv.Requests()-before)
+	}
+}
@@ -0,0 +1,149 @@
+package tlspage
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// allowed difference between our clock and the CA's when checking NotBefore
+const clockSkew = 5 * time.Minute
+
+// VerifyCertificate checks a certificate chain returned by the server against the PEM-encoded CSR
+// it was requested with. The leaf must have the CSR's public key and exactly the CSR's wildcard
+// name, it must be currently valid, and each certificate must be signed by the next one.
+func VerifyCertificate(csrPEM string, certificatePEMs []string) error {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		return fmt.Errorf("failed to decode PEM CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse CSR: %v", err)
+	}
+	if len(csr.DNSNames) != 1 {
+		return fmt.Errorf("CSR has %d DNS names, expected 1", len(csr.DNSNames))
+	}
+	base := strings.TrimPrefix(csr.DNSNames[0], "*.")
+
+	certs, err := parseCertificates(certificatePEMs)
+	if err != nil {
+		return err
+	}
+	csrFingerprint, err := SPKIFingerprint(csr.PublicKey)
+	if err != nil {
+		return err
+	}
+	leafFingerprint, err := SPKIFingerprint(certs[0].PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(csrFingerprint, leafFingerprint) {
+		return fmt.Errorf(
+			"certificate public key %x does not match CSR public key %x",
+			leafFingerprint,
+			csrFingerprint,
+		)
+	}
+	return verifyChain(certs, base)
+}
+
+// VerifyCertificateForHostname checks a certificate chain for a key-pinned base name
+// (ex: "xxx.xxx.tls.page"). It performs the same checks as VerifyCertificate, using the
+// fingerprint in the base name in place of the CSR's public key.
+func VerifyCertificateForHostname(hostname string, certificatePEMs []string) error {
+	certs, err := parseCertificates(certificatePEMs)
+	if err != nil {
+		return err
+	}
+	return verifyChain(certs, hostname)
+}
+
+// verifyChain checks that the leaf is for "*."+base and pinned to the key in base, that it is
+// within its validity period and that the chain links together.
+func verifyChain(certs []*x509.Certificate, base string) error {
+	// the origin is whatever follows the two fingerprint labels
+	parts := strings.SplitN(base, ".", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("%s is not a key-pinned hostname", base)
+	}
+	pinned, err := ParseHostname(base, parts[2])
+	if err != nil {
+		return err
+	}
+	if pinned.IPLabel != "" {
+		return fmt.Errorf("%s is not a key-pinned base name", base)
+	}
+
+	leaf := certs[0]
+	err = pinned.VerifyPublicKey(leaf.PublicKey)
+	if err != nil {
+		return fmt.Errorf("certificate is not pinned to its hostname: %v", err)
+	}
+	expected := "*." + pinned.BaseName()
+	if len(leaf.DNSNames) != 1 || !strings.EqualFold(leaf.DNSNames[0], expected) {
+		return fmt.Errorf("certificate names %v do not match expected %s", leaf.DNSNames, expected)
+	}
+
+	for i, cert := range certs {
+		if !cert.NotAfter.After(cert.NotBefore) {
+			return fmt.Errorf(
+				"certificate %d (%s) expires before it becomes valid",
+				i,
+				cert.Subject,
+			)
+		}
+	}
+	now := time.Now()
+	if now.Add(clockSkew).Before(leaf.NotBefore) {
+		return fmt.Errorf(
+			"certificate is not valid until %s",
+			leaf.NotBefore.Format(time.RFC3339),
+		)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf(
+			"certificate expired at %s",
+			leaf.NotAfter.Format(time.RFC3339),
+		)
+	}
+
+	for i := 0; i < len(certs)-1; i++ {
+		child, parent := certs[i], certs[i+1]
+		if !bytes.Equal(child.RawIssuer, parent.RawSubject) {
+			return fmt.Errorf(
+				"certificate %d was issued by %s, but the next certificate is %s",
+				i,
+				child.Issuer,
+				parent.Subject,
+			)
+		}
+		err = child.CheckSignatureFrom(parent)
+		if err != nil {
+			return fmt.Errorf("certificate %d is not signed by the next certificate: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func parseCertificates(certificatePEMs []string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, certPEM := range certificatePEMs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("failed to decode PEM certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+	return certs, nil
+}
@@ -0,0 +1,120 @@
+package tlspage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyCertificate(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := func() (string, string) {
+		privKeyPEM, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostname, err := Hostname(privKeyPEM, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return privKeyPEM, hostname
+	}
+	issue := func(privKeyPEM string, names []string, notAfter time.Time) []string {
+		signer, err := ParsePrivateKey(privKeyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     names,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, signer.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		}
+	}
+
+	privKeyPEM, hostname := newKey()
+	csrPEM, err := GenerateCSR(privKeyPEM, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyPEM, otherHostname := newKey()
+	tomorrow := time.Now().Add(24 * time.Hour)
+
+	// a leaf followed by itself rather than by its issuer
+	brokenChain := issue(privKeyPEM, []string{"*." + hostname}, tomorrow)
+	brokenChain[1] = brokenChain[0]
+
+	tests := []struct {
+		name    string
+		certs   []string
+		wantErr string
+	}{
+		{"valid", issue(privKeyPEM, []string{"*." + hostname}, tomorrow), ""},
+		{"wrong key", issue(otherKeyPEM, []string{"*." + otherHostname}, tomorrow), "does not match CSR public key"},
+		{"wrong name", issue(privKeyPEM, []string{"*." + otherHostname}, tomorrow), "do not match expected"},
+		{"extra name", issue(privKeyPEM, []string{"*." + hostname, "example.com"}, tomorrow), "do not match expected"},
+		{"expired", issue(privKeyPEM, []string{"*." + hostname}, time.Now().Add(-time.Minute)), "expired"},
+		{"broken chain", brokenChain, "was issued by"},
+		{"no certificates", nil, "no certificates"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyCertificate(csrPEM, tt.certs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyCertificate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyCertificate() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	err = VerifyCertificateForHostname(hostname, tests[0].certs)
+	if err != nil {
+		t.Errorf("VerifyCertificateForHostname() error = %v", err)
+	}
+	err = VerifyCertificateForHostname(otherHostname, tests[0].certs)
+	if err == nil {
+		t.Errorf("VerifyCertificateForHostname() with wrong hostname succeeded")
+	}
+}